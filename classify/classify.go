@@ -0,0 +1,246 @@
+// Package classify computes the NAT behavior verdicts of a punch-check test
+// from the raw observations of its probes.
+//
+// The probes of a test are named after the client ports C0..C4, and the
+// ports of the two relays A0, A1 and B0, B1. Tests can use more relays and
+// relay ports, whose probes give additional observations for the mapping and
+// filtering verdicts.
+package classify
+
+import (
+	"net"
+
+	. "github.com/delthas/punch-check"
+)
+
+// Observations are the raw observations of a test. Zero NAT ports denote
+// probes that were not received.
+type Observations struct {
+	IP      net.IP `json:"ip"`                 // public IP of the control connection
+	LocalIP net.IP `json:"local_ip,omitempty"` // local IP of the client, if sent
+	Ports   []int  `json:"ports"`              // client ports C0..C4
+
+	NATPorts []int    `json:"nat_ports"` // NAT ports of C* -> A0
+	NATIPs   []net.IP `json:"nat_ips"`   // NAT IPs of C* -> A0
+
+	PortDependentNATPort     int    `json:"port_dependent_nat_port"`     // NAT port of C0 -> A1
+	PortDependentNATIP       net.IP `json:"port_dependent_nat_ip"`       // NAT IP of C0 -> A1
+	EndpointDependentNATPort int    `json:"endpoint_dependent_nat_port"` // NAT port of C0 -> B0
+	EndpointDependentNATIP   net.IP `json:"endpoint_dependent_nat_ip"`   // NAT IP of C0 -> B0
+
+	Received                  bool `json:"received"`                    // A0 -> C1
+	ReceivedPortDependent     bool `json:"received_port_dependent"`     // A1 -> C1
+	ReceivedEndpointDependent bool `json:"received_endpoint_dependent"` // B0 -> C1
+	ReceivedHairpinning       bool `json:"received_hairpinning"`        // C2 -> C1
+
+	BurstPorts    []int `json:"burst_ports,omitempty"`     // extra client ports, used in sequence
+	BurstNATPorts []int `json:"burst_nat_ports,omitempty"` // NAT ports of burst -> A0
+
+	// Observations of all relay ports, by relay then relay port, if the test
+	// used them rather than only A0, A1 and B0. Their A1 and B0 entries are
+	// also set in the fields above.
+	RelayNATPorts  [][]int    `json:"relay_nat_ports,omitempty"` // NAT ports of C0 -> relay port
+	RelayNATIPs    [][]net.IP `json:"relay_nat_ips,omitempty"`   // NAT IPs of C0 -> relay port
+	ReceivedRelays [][]bool   `json:"received_relays,omitempty"` // relay port -> C1
+}
+
+// relayObservation is an observation of a probe between C0 or C1 and a relay
+// port other than A0.
+type relayObservation struct {
+	relay int  // index of the relay, 0 for A
+	match bool // the mapping is the mapping of C0 -> A0, or the probe was received
+}
+
+// PublicIPs returns the public IPs of all the mappings seen by relays.
+func (o *Observations) PublicIPs() []net.IP {
+	var ips []net.IP
+	for _, ip := range o.NATIPs {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if o.PortDependentNATIP != nil {
+		ips = append(ips, o.PortDependentNATIP)
+	}
+	if o.EndpointDependentNATIP != nil {
+		ips = append(ips, o.EndpointDependentNATIP)
+	}
+	for _, relayIPs := range o.RelayNATIPs {
+		for _, ip := range relayIPs {
+			if ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+func (o *Observations) IsPublicIP(ip net.IP) bool {
+	for _, publicIP := range o.PublicIPs() {
+		if publicIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify returns the verdicts of a test from its observations.
+func Classify(o *Observations) *MessageResult {
+	result := &MessageResult{
+		IP:       o.IP,
+		Ports:    o.Ports,
+		NATPorts: o.NATPorts,
+	}
+	if !o.Received || len(o.NATPorts) == 0 || o.NATPorts[0] == 0 || len(o.NATIPs) == 0 {
+		result.UDPBlocked = true
+		return result
+	}
+	publicIP := o.NATIPs[0]
+	result.UDPIP = publicIP
+	if o.LocalIP != nil {
+		result.LocalIP = o.LocalIP
+	}
+	if o.LocalIP != nil && o.LocalIP.To4() == nil && publicIP.To4() == nil {
+		// IPv4 clients are almost always behind a NAT, only report NAT66 and
+		// NPTv6
+		result.Translation = DetectTranslation(o.LocalIP, publicIP)
+	}
+	result.Pooling = PoolingPaired
+	for _, ip := range o.PublicIPs() {
+		if !ip.Equal(publicIP) {
+			result.Pooling = PoolingArbitrary
+		}
+	}
+	confidence := &Confidence{
+		Relays:     2,
+		RelayPorts: 2,
+	}
+	if len(o.RelayNATPorts) > 0 {
+		confidence.Relays = len(o.RelayNATPorts)
+		confidence.RelayPorts = len(o.RelayNATPorts[0])
+	}
+	result.Mapping, confidence.Mapping = behavior(o.mappingObservations(publicIP))
+	result.Filtering, confidence.Filtering = behavior(o.filteringObservations())
+	result.Confidence = confidence
+	result.Hairpinning = o.ReceivedHairpinning
+	result.PreservesParity = true
+	result.PreservesPort = true
+	for i, port := range o.Ports {
+		if i >= len(o.NATPorts) {
+			break
+		}
+		natPort := o.NATPorts[i]
+		if natPort == 0 {
+			continue
+		}
+		if port%2 != natPort%2 {
+			result.PreservesParity = false
+		}
+		if port != natPort {
+			result.PreservesPort = false
+		}
+	}
+	result.PreservesContiguity = contiguous(o.NATPorts)
+	if len(o.BurstPorts) > 0 {
+		result.BurstPorts = o.BurstPorts
+		result.BurstNATPorts = o.BurstNATPorts
+		result.PortPrediction = predictPorts(o.BurstNATPorts)
+		if p := result.PortPrediction; p != nil {
+			// burst mappings are created in sequence, so they are more reliable
+			result.PreservesContiguity = (p.Delta == 1 || p.Delta == -1) && p.Confidence == 1
+		}
+	}
+	return result
+}
+
+// mappingObservations returns whether the mappings of C0 to relay ports other
+// than A0 are the mapping of C0 -> A0.
+func (o *Observations) mappingObservations(publicIP net.IP) []relayObservation {
+	same := func(port int, ip net.IP) bool {
+		return port == o.NATPorts[0] && ip.Equal(publicIP)
+	}
+	if len(o.RelayNATPorts) == 0 {
+		return []relayObservation{
+			{relay: 0, match: same(o.PortDependentNATPort, o.PortDependentNATIP)},         // C0 -> A1
+			{relay: 1, match: same(o.EndpointDependentNATPort, o.EndpointDependentNATIP)}, // C0 -> B0
+		}
+	}
+	var observations []relayObservation
+	for i, ports := range o.RelayNATPorts {
+		for j, port := range ports {
+			if i == 0 && j == 0 {
+				continue
+			}
+			var ip net.IP
+			if i < len(o.RelayNATIPs) && j < len(o.RelayNATIPs[i]) {
+				ip = o.RelayNATIPs[i][j]
+			}
+			observations = append(observations, relayObservation{relay: i, match: same(port, ip)})
+		}
+	}
+	return observations
+}
+
+// filteringObservations returns whether the probes of relay ports other than
+// A0 to C1 were received.
+func (o *Observations) filteringObservations() []relayObservation {
+	if len(o.ReceivedRelays) == 0 {
+		return []relayObservation{
+			{relay: 0, match: o.ReceivedPortDependent},     // A1 -> C1
+			{relay: 1, match: o.ReceivedEndpointDependent}, // B0 -> C1
+		}
+	}
+	var observations []relayObservation
+	for i, received := range o.ReceivedRelays {
+		for j, r := range received {
+			if i == 0 && j == 0 {
+				continue
+			}
+			observations = append(observations, relayObservation{relay: i, match: r})
+		}
+	}
+	return observations
+}
+
+// behavior returns the behavior most consistent with observations, preferring
+// the least restrictive behavior on ties, and the ratio of observations
+// consistent with it. An endpoint-independent behavior matches for all relay
+// ports, an address-dependent behavior only for the ports of A, and an
+// address and port-dependent behavior for none.
+func behavior(observations []relayObservation) (Behavior, float64) {
+	var best Behavior
+	bestCount := -1
+	for _, b := range []Behavior{EndpointIndependent, AddressDependent, AddressAndPortDependent} {
+		count := 0
+		for _, obs := range observations {
+			expected := b == EndpointIndependent || (b == AddressDependent && obs.relay == 0)
+			if obs.match == expected {
+				count++
+			}
+		}
+		if count > bestCount {
+			best = b
+			bestCount = count
+		}
+	}
+	if len(observations) == 0 {
+		return best, 0
+	}
+	return best, float64(bestCount) / float64(len(observations))
+}
+
+// contiguous returns whether the NAT ports of C* -> A0 were assigned
+// contiguously, that is whether the NAT ports of mappings created one after the
+// other differ by 1 in either direction, ignoring lost probes. The mappings are
+// created from C4 to C0.
+func contiguous(natPorts []int) bool {
+	for i := 1; i < len(natPorts); i++ {
+		if natPorts[i-1] == 0 || natPorts[i] == 0 {
+			continue
+		}
+		if delta := natPorts[i-1] - natPorts[i]; delta != 1 && delta != -1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,325 @@
+package classify
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	. "github.com/delthas/punch-check"
+)
+
+var (
+	localIP  = net.ParseIP("192.168.0.2").To4()
+	publicIP = net.ParseIP("5.0.0.1").To4()
+	otherIP  = net.ParseIP("5.0.0.2").To4()
+)
+
+// fullCone returns the observations of an endpoint-independent NAT that
+// preserves ports, where every probe arrived.
+func fullCone() *Observations {
+	ports := []int{34500, 34501, 34502, 34503, 34504}
+	return &Observations{
+		IP:                        publicIP,
+		LocalIP:                   localIP,
+		Ports:                     ports,
+		NATPorts:                  []int{34500, 34501, 34502, 34503, 34504},
+		NATIPs:                    []net.IP{publicIP, publicIP, publicIP, publicIP, publicIP},
+		PortDependentNATPort:      34500,
+		PortDependentNATIP:        publicIP,
+		EndpointDependentNATPort:  34500,
+		EndpointDependentNATIP:    publicIP,
+		Received:                  true,
+		ReceivedPortDependent:     true,
+		ReceivedEndpointDependent: true,
+		ReceivedHairpinning:       true,
+	}
+}
+
+// ipv6 replaces the IPs of o with a local and a public IPv6 address.
+func ipv6(o *Observations, local string, public string) {
+	publicIP := net.ParseIP(public)
+	o.IP = publicIP
+	o.LocalIP = net.ParseIP(local)
+	for i := range o.NATIPs {
+		o.NATIPs[i] = publicIP
+	}
+	o.PortDependentNATIP = publicIP
+	o.EndpointDependentNATIP = publicIP
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Observations)
+		check  func(t *testing.T, r *MessageResult)
+	}{{
+		name:   "full cone",
+		modify: func(o *Observations) {},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, EndpointIndependent)
+			expect(t, "filtering", r.Filtering, EndpointIndependent)
+			expect(t, "hairpinning", r.Hairpinning, true)
+			expect(t, "pooling", r.Pooling, PoolingPaired)
+			expect(t, "translation", r.Translation, Translation(""))
+			expect(t, "port preservation", r.PreservesPort, true)
+			expect(t, "parity preservation", r.PreservesParity, true)
+			expect(t, "contiguity preservation", r.PreservesContiguity, true)
+		},
+	}, {
+		name: "nothing received",
+		modify: func(o *Observations) {
+			*o = Observations{
+				IP:       publicIP,
+				Ports:    o.Ports,
+				NATPorts: make([]int, len(o.Ports)),
+				NATIPs:   make([]net.IP, len(o.Ports)),
+			}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "udp blocked", r.UDPBlocked, true)
+		},
+	}, {
+		name: "inbound blocked",
+		modify: func(o *Observations) {
+			o.Received = false
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "udp blocked", r.UDPBlocked, true)
+		},
+	}, {
+		name: "first mapping missing",
+		modify: func(o *Observations) {
+			o.NATPorts[0] = 0
+			o.NATIPs[0] = nil
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "udp blocked", r.UDPBlocked, true)
+		},
+	}, {
+		name: "empty observations",
+		modify: func(o *Observations) {
+			*o = Observations{}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "udp blocked", r.UDPBlocked, true)
+		},
+	}, {
+		name: "address-dependent filtering",
+		modify: func(o *Observations) {
+			o.ReceivedEndpointDependent = false
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "filtering", r.Filtering, AddressDependent)
+		},
+	}, {
+		name: "address and port-dependent filtering",
+		modify: func(o *Observations) {
+			o.ReceivedEndpointDependent = false
+			o.ReceivedPortDependent = false
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "filtering", r.Filtering, AddressAndPortDependent)
+		},
+	}, {
+		name: "address-dependent mapping",
+		modify: func(o *Observations) {
+			o.EndpointDependentNATPort = 40000
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, AddressDependent)
+		},
+	}, {
+		name: "address and port-dependent mapping",
+		modify: func(o *Observations) {
+			o.PortDependentNATPort = 40000
+			o.EndpointDependentNATPort = 40001
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, AddressAndPortDependent)
+			expect(t, "hole punching", r.HolePunching(), false)
+		},
+	}, {
+		name: "mapping with another IP",
+		modify: func(o *Observations) {
+			o.EndpointDependentNATIP = otherIP
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, AddressDependent)
+			expect(t, "pooling", r.Pooling, PoolingArbitrary)
+		},
+	}, {
+		name: "mapping probe lost",
+		modify: func(o *Observations) {
+			o.PortDependentNATPort = 0
+			o.PortDependentNATIP = nil
+			o.EndpointDependentNATPort = 0
+			o.EndpointDependentNATIP = nil
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, AddressAndPortDependent)
+			expect(t, "pooling", r.Pooling, PoolingPaired)
+		},
+	}, {
+		name: "IPv6 no translation",
+		modify: func(o *Observations) {
+			ipv6(o, "2001:db8:5::2", "2001:db8:5::2")
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "translation", r.Translation, TranslationNone)
+		},
+	}, {
+		name: "IPv6 prefix translation",
+		modify: func(o *Observations) {
+			ipv6(o, "fd00::1234:5678:9abc:def0", "2001:db8:5::1234:5678:9abc:1111")
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "translation", r.Translation, TranslationPrefix)
+		},
+	}, {
+		name: "IPv6 address translation",
+		modify: func(o *Observations) {
+			ipv6(o, "fd00::2", "2001:db8:5::1:1")
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "translation", r.Translation, TranslationAddress)
+		},
+	}, {
+		name: "unknown local IP",
+		modify: func(o *Observations) {
+			o.LocalIP = nil
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "translation", r.Translation, Translation(""))
+		},
+	}, {
+		name: "contiguous assignment",
+		modify: func(o *Observations) {
+			o.NATPorts = []int{20005, 20004, 20003, 20002, 20001}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "port preservation", r.PreservesPort, false)
+			expect(t, "parity preservation", r.PreservesParity, false)
+			expect(t, "contiguity preservation", r.PreservesContiguity, true)
+		},
+	}, {
+		name: "contiguous ascending assignment",
+		modify: func(o *Observations) {
+			o.NATPorts = []int{20000, 20001, 20002, 20003, 20004}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "port preservation", r.PreservesPort, false)
+			expect(t, "contiguity preservation", r.PreservesContiguity, true)
+		},
+	}, {
+		name: "non-contiguous assignment",
+		modify: func(o *Observations) {
+			o.NATPorts = []int{20000, 20002, 20004, 20006, 20008}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "contiguity preservation", r.PreservesContiguity, false)
+		},
+	}, {
+		name: "contiguous assignment with a lost probe",
+		modify: func(o *Observations) {
+			o.NATPorts = []int{20004, 20003, 0, 20001, 20000}
+			o.NATIPs[2] = nil
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "parity preservation", r.PreservesParity, true)
+			expect(t, "contiguity preservation", r.PreservesContiguity, true)
+		},
+	}, {
+		name: "contiguous assignment with burst delta",
+		modify: func(o *Observations) {
+			o.NATPorts = []int{20005, 20004, 20003, 20002, 20001}
+			o.BurstPorts = []int{34505, 34506, 34507, 34508}
+			o.BurstNATPorts = []int{20010, 20012, 20014, 20016}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "contiguity preservation", r.PreservesContiguity, false)
+			if r.PortPrediction == nil {
+				t.Fatalf("no port prediction")
+			}
+			expect(t, "port prediction delta", r.PortPrediction.Delta, 2)
+			expect(t, "port prediction samples", r.PortPrediction.Samples, 3)
+		},
+	}, {
+		name: "burst too short",
+		modify: func(o *Observations) {
+			o.BurstPorts = []int{34505, 34506, 34507}
+			o.BurstNATPorts = []int{20010, 0, 20014}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			if r.PortPrediction != nil {
+				t.Errorf("unexpected port prediction: %v", r.PortPrediction)
+			}
+		},
+	}, {
+		name: "inconsistent mapping over more relays",
+		modify: func(o *Observations) {
+			o.RelayNATPorts = [][]int{{34500, 34500}, {34500, 34500}, {34500, 40000}}
+			o.RelayNATIPs = [][]net.IP{{publicIP, publicIP}, {publicIP, publicIP}, {publicIP, publicIP}}
+			o.ReceivedRelays = [][]bool{{true, true}, {true, true}, {true, true}}
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			expect(t, "mapping", r.Mapping, EndpointIndependent)
+			expect(t, "mapping confidence", r.Confidence.Mapping, 0.8)
+			expect(t, "filtering confidence", r.Confidence.Filtering, 1.0)
+			expect(t, "relays", r.Confidence.Relays, 3)
+		},
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			o := fullCone()
+			test.modify(o)
+			test.check(t, Classify(o))
+		})
+	}
+}
+
+func TestClassifyRecorded(t *testing.T) {
+	data, err := json.Marshal(fullCone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o Observations
+	if err := json.Unmarshal(data, &o); err != nil {
+		t.Fatal(err)
+	}
+	// decoded IPv4 addresses use the 16-byte form, so compare verdicts only
+	if expected, got := Classify(fullCone()).String(), Classify(&o).String(); expected != got {
+		t.Errorf("classification of recorded observations differs: expected %q, got %q", expected, got)
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	tests := []struct {
+		natPorts   []int
+		delta      int
+		confidence float64
+	}{
+		{[]int{100, 101, 102, 103}, 1, 1},
+		{[]int{100, 102, 104, 107}, 2, 2.0 / 3},
+		{[]int{100, 0, 101, 102, 103}, 1, 1},
+		{[]int{103, 102, 101}, -1, 1},
+		{[]int{100, 103, 106, 101, 104}, 3, 0.75},
+	}
+	for _, test := range tests {
+		p := predictPorts(test.natPorts)
+		if p == nil {
+			t.Errorf("%v: no prediction", test.natPorts)
+			continue
+		}
+		if p.Delta != test.delta || p.Confidence != test.confidence {
+			t.Errorf("%v: expected delta %d with confidence %v, got delta %d with confidence %v", test.natPorts, test.delta, test.confidence, p.Delta, p.Confidence)
+		}
+	}
+}
+
+func expect(t *testing.T, name string, got interface{}, expected interface{}) {
+	t.Helper()
+	if got != expected {
+		t.Errorf("%s: expected %v, got %v", name, expected, got)
+	}
+}
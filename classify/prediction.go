@@ -0,0 +1,47 @@
+package classify
+
+import (
+	. "github.com/delthas/punch-check"
+)
+
+// predictPorts analyzes the deltas between the NAT ports of mappings created
+// in sequence, and returns nil if there are not enough of them.
+func predictPorts(natPorts []int) *PortPrediction {
+	var deltas []int
+	for i := 1; i < len(natPorts); i++ {
+		if natPorts[i-1] == 0 || natPorts[i] == 0 {
+			continue
+		}
+		deltas = append(deltas, natPorts[i]-natPorts[i-1])
+	}
+	if len(deltas) < 2 {
+		return nil
+	}
+
+	counts := make(map[int]int)
+	var sum float64
+	for _, delta := range deltas {
+		counts[delta]++
+		sum += float64(delta)
+	}
+	mean := sum / float64(len(deltas))
+	var variance float64
+	for _, delta := range deltas {
+		variance += (float64(delta) - mean) * (float64(delta) - mean)
+	}
+	variance /= float64(len(deltas))
+
+	mode := deltas[0]
+	for delta, count := range counts {
+		if count > counts[mode] || (count == counts[mode] && delta < mode) {
+			mode = delta
+		}
+	}
+	return &PortPrediction{
+		Delta:      mode,
+		Mean:       mean,
+		Variance:   variance,
+		Confidence: float64(counts[mode]) / float64(len(deltas)),
+		Samples:    len(deltas),
+	}
+}
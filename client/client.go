@@ -1,143 +1,507 @@
-package main
+// Package client runs a punch-check NAT test against a punch-check server.
+package client
 
 import (
-	"flag"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"os"
+	"strconv"
 	"sync"
-	"sync/atomic"
 
 	. "github.com/delthas/punch-check"
 )
 
-var defaultServerHost = "delthas.fr"
-var defaultStartPort = 34500
+var DefaultServer = "delthas.fr"
+var DefaultStartPort = 34500
 
-var logErr = log.New(os.Stderr, "", 0)
-var logDebug *log.Logger
+// clients always send MessageHello, so they require protocol version 1
+var minProtocolVersion = 1
 
-var closed uint32 = 0
+var socketsCount = 25
+var socketsTries = 10
 
-func main() {
-	serverHost := flag.String("host", defaultServerHost, "server hostname[:port]")
-	debug := flag.Bool("debug", false, "add debug logging")
-	flag.Parse()
+type Stage int
 
-	if *debug {
-		logDebug = log.New(os.Stderr, "debug: ", log.Ldate|log.Ltime|log.Lshortfile)
-	} else {
-		logDebug = log.New(ioutil.Discard, "", 0)
+const (
+	StageResolving Stage = iota
+	StageConnecting
+	StageTesting
+	StageDone
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageResolving:
+		return "resolving server"
+	case StageConnecting:
+		return "connecting to server"
+	case StageTesting:
+		return "testing"
+	case StageDone:
+		return "done"
+	default:
+		return fmt.Sprintf("Stage(%d)", int(s))
 	}
+}
 
-	var serverAddr *net.TCPAddr
-	_, _, err := net.SplitHostPort(*serverHost)
-	if err != nil {
-		serverAddr, err = ResolveTCPBySRV("punchcheck", *serverHost)
-		if err != nil {
-			logErr.Fatalf("failed resolving server host %q: %v", *serverHost, err)
-		}
-	} else {
-		serverAddr, err = net.ResolveTCPAddr("tcp4", *serverHost)
+type Progress struct {
+	Stage    Stage
+	Sent     int    // UDP packets sent so far
+	Received int    // UDP packets received so far
+	Message  string // last status message sent by the server, if any
+	// PairingCode is the code of the pairing session, once the server created
+	// or joined it.
+	PairingCode string
+}
+
+type Options struct {
+	// Server is the server hostname[:port]. If no port is given, the server
+	// address is resolved with an SRV lookup. Defaults to DefaultServer.
+	Server string
+	// StartPort is the first local UDP port to try. Defaults to DefaultStartPort.
+	StartPort int
+	// IPv6 runs the test over IPv6 rather than IPv4.
+	IPv6 bool
+	// Lifetime additionally measures the NAT mapping lifetime, which can take
+	// up to an hour.
+	Lifetime bool
+	// Refresh additionally tests whether inbound and outbound packets refresh
+	// NAT mappings. It implies Lifetime.
+	Refresh bool
+	// Pair additionally runs a hole-punching test with another client. If
+	// PairingCode is empty, the server creates a pairing session, whose code is
+	// reported in Progress.PairingCode, for the other client to join.
+	Pair bool
+	// PairingCode is the code of the pairing session to join. It implies Pair.
+	PairingCode string
+	// TCP additionally tests the NAT behavior for TCP connections. The
+	// transport must implement TCPTransport.
+	TCP bool
+	// Progress, if set, is called whenever the test progresses. Calls are
+	// serialized.
+	Progress func(Progress)
+	// Debug, if set, receives debug logs.
+	Debug *log.Logger
+	// Transport, if set, creates the network connections. Defaults to
+	// NetTransport.
+	Transport Transport
+	// TLSConfig, if set, is used to connect to the server over TLS. Its server
+	// name defaults to the server hostname.
+	TLSConfig *tls.Config
+}
+
+type Result struct {
+	Message string         // human-readable test results
+	Details *MessageResult // nil if the server only sent human-readable results
+}
+
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error: %s", e.Message)
+}
+
+type check struct {
+	options    Options
+	tcpNetwork string
+	udpNetwork string
+	hello      *MessageHello // server hello
+
+	control   net.Conn
+	writeLock sync.Mutex
+
+	cs        []net.PacketConn
+	ports     []int
+	startPort int
+
+	tcpLock   sync.Mutex
+	tcpConns  []io.Closer // TCP listeners and connections, kept open until the end of the test
+	tcpClosed bool
+
+	progressLock sync.Mutex
+	progress     Progress
+}
+
+// Check runs a NAT test. It returns when the test is complete, when an error
+// occurs, or when ctx is done.
+func Check(ctx context.Context, options Options) (*Result, error) {
+	if options.Server == "" {
+		options.Server = DefaultServer
+	}
+	if options.StartPort == 0 {
+		options.StartPort = DefaultStartPort
+	}
+	if options.Debug == nil {
+		options.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	if options.Transport == nil {
+		options.Transport = NetTransport
+	}
+	c := &check{
+		options:    options,
+		tcpNetwork: "tcp4",
+		udpNetwork: "udp4",
+	}
+	if options.IPv6 {
+		c.tcpNetwork = "tcp6"
+		c.udpNetwork = "udp6"
+	}
+	return c.run(ctx)
+}
+
+func (c *check) report(f func(p *Progress)) {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	f(&c.progress)
+	if c.options.Progress != nil {
+		c.options.Progress(c.progress)
+	}
+}
+
+func (c *check) write(m Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return WriteMessage(c.control, m)
+}
+
+// tcpListenPorts are the indexes of the client ports that accept TCP
+// connections in the TCP test
+var tcpListenPorts = []int{1, 2}
+
+func (c *check) hold(closer io.Closer) {
+	c.tcpLock.Lock()
+	defer c.tcpLock.Unlock()
+	if c.tcpClosed {
+		closer.Close()
+		return
+	}
+	c.tcpConns = append(c.tcpConns, closer)
+}
+
+func (c *check) closeTCP() {
+	c.tcpLock.Lock()
+	defer c.tcpLock.Unlock()
+	for _, closer := range c.tcpConns {
+		closer.Close()
+	}
+	c.tcpConns = nil
+	c.tcpClosed = true
+}
+
+// listenTCP accepts TCP connections on the client ports used in the TCP test,
+// so that connections through the NAT are not reset by the client.
+func (c *check) listenTCP() error {
+	transport := c.options.Transport.(TCPTransport)
+	for _, i := range tcpListenPorts {
+		l, err := transport.Listen(c.tcpNetwork, net.JoinHostPort("", strconv.Itoa(c.ports[i])))
 		if err != nil {
-			logErr.Fatalf("failed resolving server host %q: %v", *serverHost, err)
+			return fmt.Errorf("listening on TCP port %d: %v", c.ports[i], err)
 		}
+		c.hold(l)
+		go func() {
+			for {
+				tc, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.options.Debug.Printf("accepted TCP connection from %v on %v", tc.RemoteAddr(), tc.LocalAddr())
+				c.hold(tc)
+			}
+		}()
 	}
+	return nil
+}
 
-	defer atomic.StoreUint32(&closed, 1)
+// dialTCP opens a TCP connection requested by the server, and replies with its
+// result.
+func (c *check) dialTCP(ctx context.Context, m *MessageConnect) {
+	address := net.JoinHostPort(net.IP(m.IP).String(), strconv.Itoa(m.Port))
+	c.options.Debug.Printf("connecting to %s from %d", address, m.LocalPort)
+	dialCtx, cancel := context.WithTimeout(ctx, TCPConnectTimeout)
+	tc, err := c.options.Transport.(TCPTransport).DialFrom(dialCtx, c.tcpNetwork, m.LocalPort, address)
+	cancel()
+	if err == nil {
+		tc.Write(m.Data)
+		c.hold(tc)
+	} else {
+		c.options.Debug.Printf("failed connecting to %s from %d: %v", address, m.LocalPort, err)
+	}
+	reply := *m
+	reply.Result = DialResult(err)
+	c.write(&reply)
+}
 
-	cs := make([]*net.UDPConn, 10)
-	var startPort int
+func (c *check) listen() error {
+	c.cs = make([]net.PacketConn, socketsCount)
+	var err error
 outer:
-	for startPort = defaultStartPort; ; startPort += len(cs) {
-		for i := range cs {
-			c, err := net.ListenUDP("udp4", &net.UDPAddr{
-				Port: startPort + i,
-			})
+	for try := 0; try < socketsTries; try++ {
+		c.startPort = c.options.StartPort + try*len(c.cs)
+		for i := range c.cs {
+			var uc net.PacketConn
+			uc, err = c.options.Transport.ListenPacket(c.udpNetwork, net.JoinHostPort("", strconv.Itoa(c.startPort+i)))
 			if err != nil {
-				if startPort > defaultStartPort+len(cs)*10 {
-					log.Fatalf("failed creating UDP sockets after 10 tries: %v", err)
+				for _, uc := range c.cs[:i] {
+					uc.Close()
 				}
 				continue outer
 			}
-			cs[i] = c
+			c.cs[i] = uc
 		}
-		break
-	}
-	ports := make([]int, len(cs))
-	for i := range ports {
-		ports[i] = startPort + i
+		c.ports = make([]int, len(c.cs))
+		for i := range c.ports {
+			c.ports[i] = c.startPort + i
+		}
+		return nil
 	}
+	c.cs = nil
+	return fmt.Errorf("creating UDP sockets: failed after %d tries: %v", socketsTries, err)
+}
 
-	control, err := net.DialTCP("tcp4", nil, serverAddr)
+func (c *check) run(ctx context.Context) (*Result, error) {
+	c.report(func(p *Progress) {
+		p.Stage = StageResolving
+	})
+	var serverAddr *net.TCPAddr
+	_, _, err := net.SplitHostPort(c.options.Server)
+	if err != nil {
+		serverAddr, err = ResolveTCPBySRV(c.tcpNetwork, "punchcheck", c.options.Server)
+	} else {
+		serverAddr, err = net.ResolveTCPAddr(c.tcpNetwork, c.options.Server)
+	}
 	if err != nil {
-		logErr.Fatalf("failed dialing server at %q: %v", *serverHost, err)
+		return nil, fmt.Errorf("resolving server host %q: %v", c.options.Server, err)
+	}
+
+	if err := c.listen(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, uc := range c.cs {
+			uc.Close()
+		}
+	}()
+	if c.options.TCP {
+		if _, ok := c.options.Transport.(TCPTransport); !ok {
+			return nil, fmt.Errorf("transport does not support TCP tests")
+		}
+		defer c.closeTCP()
+		if err := c.listenTCP(); err != nil {
+			return nil, err
+		}
 	}
-	control.SetNoDelay(true)
-	defer control.Close()
-	logDebug.Printf("connected to server: %q", *serverHost)
 
-	WriteMessage(control, &MessagePorts{
-		Ports: ports,
+	c.report(func(p *Progress) {
+		p.Stage = StageConnecting
 	})
+	c.control, err = c.options.Transport.Dial(ctx, c.tcpNetwork, serverAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("dialing server at %q: %v", c.options.Server, err)
+	}
+	if control, ok := c.control.(*net.TCPConn); ok {
+		control.SetNoDelay(true)
+	}
+	if c.options.TLSConfig != nil {
+		c.control = TLSClient(c.control, c.options.TLSConfig, c.options.Server)
+	}
+	defer c.control.Close()
+	c.options.Debug.Printf("connected to server: %q", c.options.Server)
+
+	done := make(chan struct{})
+	defer close(done)
+	errCh := make(chan error, len(c.cs))
+	fail := func(err error) {
+		errCh <- err
+		c.control.Close()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.control.Close()
+		case <-done:
+		}
+	}()
 
-	var writeLock sync.Mutex
-	for i, c := range cs {
-		c := c
+	if err := c.write(&MessageHello{
+		Version:    ProtocolVersion,
+		MinVersion: minProtocolVersion,
+		Features:   Features,
+	}); err != nil {
+		return nil, err
+	}
+	var tests []string
+	if c.options.Lifetime || c.options.Refresh {
+		tests = append(tests, FeatureLifetime)
+	}
+	if c.options.Refresh {
+		tests = append(tests, FeatureRefresh)
+	}
+	if c.options.TCP {
+		tests = append(tests, TestTCP)
+	}
+	if c.options.Pair || c.options.PairingCode != "" {
+		if err := c.write(&MessagePair{
+			Code: c.options.PairingCode,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	var localIP net.IP
+	if addr, ok := c.control.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	if err := c.write(&MessagePorts{
+		Ports: c.ports,
+		IP:    localIP,
+		Tests: tests,
+	}); err != nil {
+		return nil, err
+	}
+
+	c.report(func(p *Progress) {
+		p.Stage = StageTesting
+	})
+	for i, uc := range c.cs {
+		uc := uc
 		i := i
 		go func() {
 			for {
 				buf := make([]byte, 1536)
-				n, addr, err := c.ReadFromUDP(buf)
+				n, a, err := uc.ReadFrom(buf)
 				if err != nil {
-					if atomic.LoadUint32(&closed) == 1 {
-						return
+					select {
+					case <-done:
+					default:
+						fail(fmt.Errorf("reading from UDP socket: %v", err))
 					}
-					logErr.Fatalf("reading from UDP socket: %v", err)
+					return
 				}
 				buf = buf[:n]
+				addr, ok := a.(*net.UDPAddr)
+				if !ok {
+					continue
+				}
 
-				logDebug.Printf("forwarding read from %s:%d on %d: %v", addr.IP.String(), addr.Port, ports[i], buf)
-				writeLock.Lock()
-				WriteMessage(control, &MessageReceive{
-					LocalPort: ports[i],
+				c.options.Debug.Printf("forwarding read from %s:%d on %d: %v", addr.IP.String(), addr.Port, c.ports[i], buf)
+				c.report(func(p *Progress) {
+					p.Received++
+				})
+				if err := c.write(&MessageReceive{
+					LocalPort: c.ports[i],
 					IP:        addr.IP,
 					Port:      addr.Port,
 					Data:      buf,
-				})
-				writeLock.Unlock()
+				}); err != nil {
+					fail(err)
+					return
+				}
 			}
 		}()
 	}
 
 	for {
-		m, err := ReadMessage(control)
+		m, err := ReadMessage(c.control)
 		if err != nil {
-			logErr.Fatalf("reading message from control socket: %v", err)
-			return
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			select {
+			case err := <-errCh:
+				return nil, err
+			default:
+			}
+			if c.hello == nil {
+				return nil, fmt.Errorf("reading handshake from control socket (the server might be outdated): %v", err)
+			}
+			return nil, fmt.Errorf("reading message from control socket: %v", err)
+		}
+		if _, ok := m.(*MessageHello); !ok && c.hello == nil {
+			if m, ok := m.(*MessageInfo); ok && m.MessageType == 0 {
+				return nil, &ServerError{Message: m.Message}
+			}
+			return nil, fmt.Errorf("invalid handshake: unexpected message type: %v", MessageType(m.Type()))
 		}
 		switch m := m.(type) {
+		case *MessageHello:
+			if c.hello != nil {
+				return nil, fmt.Errorf("invalid handshake: duplicate hello message")
+			}
+			if _, err := m.Negotiate(ProtocolVersion, minProtocolVersion); err != nil {
+				return nil, fmt.Errorf("invalid handshake: %v", err)
+			}
+			if c.options.IPv6 && !m.Supports(FeatureIPv6) {
+				return nil, fmt.Errorf("server does not support IPv6 tests")
+			}
+			if (c.options.Lifetime || c.options.Refresh) && !m.Supports(FeatureLifetime) {
+				return nil, fmt.Errorf("server does not support mapping lifetime tests")
+			}
+			if c.options.Refresh && !m.Supports(FeatureRefresh) {
+				return nil, fmt.Errorf("server does not support mapping refresh tests")
+			}
+			if (c.options.Pair || c.options.PairingCode != "") && !m.Supports(FeaturePairing) {
+				return nil, fmt.Errorf("server does not support pairing tests")
+			}
+			if c.options.TCP && !m.Supports(FeatureTCP) {
+				return nil, fmt.Errorf("server does not support TCP tests")
+			}
+			c.hello = m
 		case *MessageSend:
-			if m.LocalPort < startPort || m.LocalPort >= startPort+len(ports) {
-				logErr.Fatalf("invalid send message: invalid local port: %d", m.LocalPort)
+			if m.LocalPort < c.startPort || m.LocalPort >= c.startPort+len(c.ports) {
+				return nil, fmt.Errorf("invalid send message: invalid local port: %d", m.LocalPort)
 			}
-			logDebug.Printf("writing to %s:%d from %d: %v", net.IP(m.IP).String(), m.Port, m.LocalPort, m.Data)
-			cs[m.LocalPort-startPort].WriteToUDP(m.Data, &net.UDPAddr{
+			c.options.Debug.Printf("writing to %s:%d from %d: %v", net.IP(m.IP).String(), m.Port, m.LocalPort, m.Data)
+			c.cs[m.LocalPort-c.startPort].WriteTo(m.Data, &net.UDPAddr{
 				IP:   m.IP,
 				Port: m.Port,
 			})
+			c.report(func(p *Progress) {
+				p.Sent++
+			})
+		case *MessageConnect:
+			if !c.options.TCP || Index(c.ports, m.LocalPort) == -1 {
+				return nil, fmt.Errorf("invalid connect message: invalid local port: %d", m.LocalPort)
+			}
+			go c.dialTCP(ctx, m)
+		case *MessagePair:
+			if !c.options.Pair && c.options.PairingCode == "" {
+				return nil, fmt.Errorf("invalid pairing message: no pairing test requested")
+			}
+			c.report(func(p *Progress) {
+				p.PairingCode = m.Code
+			})
 		case *MessageInfo:
 			if m.MessageType == 0 {
-				logErr.Fatalf("error: %s", m.Message)
+				return nil, &ServerError{Message: m.Message}
+			} else if m.MessageType == 2 {
+				c.report(func(p *Progress) {
+					p.Message = m.Message
+				})
+				break
 			} else if m.MessageType != 1 {
-				logErr.Fatalf("message of unknown message type %d: %s", m.MessageType, m.Message)
+				return nil, fmt.Errorf("message of unknown message type %d: %s", m.MessageType, m.Message)
 			}
-			fmt.Println(m.Message)
-			return
+			c.report(func(p *Progress) {
+				p.Stage = StageDone
+			})
+			return &Result{
+				Message: m.Message,
+			}, nil
+		case *MessageResult:
+			c.report(func(p *Progress) {
+				p.Stage = StageDone
+			})
+			return &Result{
+				Message: m.String(),
+				Details: m,
+			}, nil
 		default:
-			logErr.Fatalf("invalid message type: %v", MessageType(m.Type()))
+			return nil, fmt.Errorf("invalid message type: %v", MessageType(m.Type()))
 		}
 	}
 }
@@ -0,0 +1,75 @@
+//go:generate rsrc -arch=amd64 -manifest client.manifest -o rsrc_amd64.syso
+//go:generate rsrc -arch=386 -manifest client.manifest -o rsrc_386.syso
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lxn/walk"
+	. "github.com/lxn/walk/declarative"
+
+	"github.com/delthas/punch-check/client"
+)
+
+var mw *walk.MainWindow
+var text *walk.TextEdit
+var progress *walk.ProgressBar
+
+func log(f string, args ...interface{}) {
+	mw.Synchronize(func() {
+		text.AppendText(strings.ReplaceAll(fmt.Sprintf(f+"\n", args...), "\n", "\r\n"))
+	})
+}
+
+func process() {
+	result, err := client.Check(context.Background(), client.Options{})
+	if err != nil {
+		if err, ok := err.(*client.ServerError); ok {
+			log("error: %s", err.Message)
+			return
+		}
+		log("%v", err)
+		return
+	}
+	log("%s", result.Message)
+}
+
+func main() {
+	size := Size{Width: 400, Height: 250}
+	err := MainWindow{
+		AssignTo: &mw,
+		Title:    "PunchCheck",
+		MinSize:  size,
+		Size:     size,
+		Layout:   VBox{},
+		Children: []Widget{
+			TextEdit{
+				AssignTo: &text,
+				ReadOnly: true,
+			},
+			ProgressBar{
+				AssignTo:    &progress,
+				MarqueeMode: true,
+				Value:       1,
+			},
+		},
+	}.Create()
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		process()
+		mw.Synchronize(func() {
+			progress.SetMarqueeMode(false)
+			progress.SetValue(100)
+		})
+	}()
+
+	code := mw.Run()
+	os.Exit(code)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/relay"
+)
+
+var logErr = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+func main() {
+	serverHost := flag.String("host", "", "server hostname[:port] (required)")
+	ipv6 := flag.Bool("ipv6", false, "also connect to the server over IPv6 to serve IPv6 tests")
+	stun := flag.Bool("stun", false, "also answer STUN binding requests on the ports")
+	keyFile := flag.String("key-file", "", "file containing the key to authenticate to the server with")
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS")
+	tlsCA := flag.String("tls-ca", "", "PEM CA file to verify the server certificate with instead of the system CAs, implies -tls")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate file to authenticate to the server with, implies -tls (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	debug := flag.Bool("debug", false, "add debug logging")
+	var portsStr []string
+	flag.Var((*StringSliceFlag)(&portsStr), "port", "port to listen on (pass multiple times for multiple ports)")
+	flag.Parse()
+
+	if len(portsStr) < RelayPortsCount {
+		fmt.Fprintf(os.Stderr, "at least %d ports are required (use -port)\n", RelayPortsCount)
+		flag.Usage()
+		return
+	}
+	if *serverHost == "" {
+		fmt.Fprintf(os.Stderr, "-host is required\n")
+		flag.Usage()
+		return
+	}
+
+	ports := make([]int, len(portsStr))
+	for i, portStr := range portsStr {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			logErr.Fatalf("failed parsing UDP port %q: %v", portStr, err)
+		}
+		ports[i] = port
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		b, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			logErr.Fatalf("failed reading key file: %v", err)
+		}
+		key = bytes.TrimSpace(b)
+		if len(key) == 0 {
+			logErr.Fatalf("key file %q is empty", *keyFile)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		var err error
+		tlsConfig, err = LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			logErr.Fatalf("failed loading TLS configuration: %v", err)
+		}
+	}
+
+	r := &relay.Relay{
+		Server:    *serverHost,
+		Ports:     ports,
+		IPv6:      *ipv6,
+		STUN:      *stun,
+		Key:       key,
+		TLSConfig: tlsConfig,
+		ErrorLog:  logErr,
+	}
+	if *debug {
+		r.Debug = log.New(os.Stderr, "debug: ", log.Ldate|log.Ltime|log.Lshortfile)
+	}
+	if err := r.Run(context.Background()); err != nil {
+		logErr.Fatalf("failed running relay: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/server"
+)
+
+var logErr = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+var shutdownTimeout = 5 * time.Second
+
+func main() {
+	serverPort := flag.Int("port", server.DefaultPort, "port to listen on")
+	var allowedRelayHosts []string
+	flag.Var((*StringSliceFlag)(&allowedRelayHosts), "relay", "relay hostname/ip, all its IPv4 and IPv6 addresses are allowed (pass multiple times for multiple relays)")
+	relayKeyFile := flag.String("relay-key-file", "", "file containing a key relays must authenticate with, in which case -relay is optional")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, to accept connections over TLS (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA file with which relays can authenticate with client certificates over TLS, in which case -relay is optional")
+	relaySelection := flag.String("relay-selection", "random", fmt.Sprintf("strategy to pick the relays of clients, one of: %s", strings.Join(server.RelaySelections, ", ")))
+	relaySelectionFile := flag.String("relay-selection-file", "", "configuration file of -relay-selection groups (lines of a group name and its IPs or CIDR networks) or pinned (lines of relay IPs used together)")
+	clientRelays := flag.Int("client-relays", ClientRelaysCount, "number of relays assigned to each client, more relays give more observations of the mapping and filtering verdicts")
+	relayPorts := flag.Int("relay-ports", RelayPortsCount, "number of ports of each relay used in tests, relays with fewer ports are not assigned to clients")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on over HTTP at /metrics, e.g. localhost:9485 (disabled if empty)")
+	var disabledTests []string
+	flag.Var((*StringSliceFlag)(&disabledTests), "disable-test", fmt.Sprintf("test to disable, one of: %s, %s, %s, %s, %s, %s (pass multiple times for multiple tests)", TestHairpinning, TestBurst, TestTCP, TestPairing, TestLifetime, TestRefresh))
+	flag.Parse()
+
+	rand.Seed(time.Now().UnixNano())
+
+	if (*tlsCert == "") != (*tlsKey == "") || (*tlsClientCA != "" && *tlsCert == "") {
+		fmt.Fprintf(os.Stderr, "-tls-cert and -tls-key must be used together, and are required by -tls-client-ca\n")
+		flag.Usage()
+		return
+	}
+	if *clientRelays < ClientRelaysCount || *relayPorts < RelayPortsCount {
+		fmt.Fprintf(os.Stderr, "-client-relays and -relay-ports must be at least %d and %d\n", ClientRelaysCount, RelayPortsCount)
+		flag.Usage()
+		return
+	}
+	if *relayKeyFile == "" && *tlsClientCA == "" && len(allowedRelayHosts) < *clientRelays {
+		fmt.Fprintf(os.Stderr, "at least %d relays are required (use -relay, -relay-key-file or -tls-client-ca)\n", *clientRelays)
+		flag.Usage()
+		return
+	}
+
+	var relayKey []byte
+	if *relayKeyFile != "" {
+		key, err := ioutil.ReadFile(*relayKeyFile)
+		if err != nil {
+			logErr.Fatalf("failed reading relay key file: %v", err)
+		}
+		relayKey = bytes.TrimSpace(key)
+		if len(relayKey) == 0 {
+			logErr.Fatalf("relay key file %q is empty", *relayKeyFile)
+		}
+	}
+
+	var selectionConfig io.Reader
+	if *relaySelectionFile != "" {
+		f, err := os.Open(*relaySelectionFile)
+		if err != nil {
+			logErr.Fatalf("failed opening relay selection file: %v", err)
+		}
+		defer f.Close()
+		selectionConfig = f
+	}
+	selection, err := server.NewRelaySelection(*relaySelection, selectionConfig)
+	if err != nil {
+		logErr.Fatalf("failed creating relay selection: %v", err)
+	}
+
+	var allowedRelays []net.IP
+	for _, relayHost := range allowedRelayHosts {
+		ips, err := net.LookupIP(relayHost)
+		if err != nil {
+			logErr.Fatalf("failed resolving relay host %q: %v", relayHost, err)
+		}
+		allowedRelays = append(allowedRelays, ips...)
+	}
+
+	var l net.Listener
+	l, err = net.ListenTCP("tcp", &net.TCPAddr{
+		Port: *serverPort,
+	})
+	if err != nil {
+		logErr.Fatalf("failed creating control server socket on port %d: %v", *serverPort, err)
+	}
+	if *tlsCert != "" {
+		config, err := LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			logErr.Fatalf("failed loading TLS configuration: %v", err)
+		}
+		if *tlsClientCA != "" {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		l = tls.NewListener(l, config)
+	}
+
+	s := &server.Server{
+		Relays:         allowedRelays,
+		RelayKey:       relayKey,
+		RelaySelection: selection,
+		ClientRelays:   *clientRelays,
+		RelayPorts:     *relayPorts,
+		ErrorLog:       logErr,
+		DisabledTests:  disabledTests,
+	}
+	if *metricsAddr != "" {
+		ml, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			logErr.Fatalf("failed creating metrics socket on %q: %v", *metricsAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.MetricsHandler())
+		go func() {
+			if err := http.Serve(ml, mux); err != nil {
+				logErr.Printf("failed serving metrics: %v", err)
+			}
+		}()
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logErr.Printf("failed shutting down server: %v", err)
+		}
+	}()
+	if err := s.Serve(l); err != nil && err != server.ErrServerClosed {
+		logErr.Fatalf("failed serving: %v", err)
+	}
+	<-shutdown
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/stun"
+)
+
+var logErr = log.New(os.Stderr, "", 0)
+
+func check(options client.Options) {
+	result, err := client.Check(context.Background(), options)
+	if err != nil {
+		if err, ok := err.(*client.ServerError); ok {
+			logErr.Fatalf("error: %s", err.Message)
+		}
+		logErr.Fatalf("%v", err)
+	}
+	fmt.Println(result.Message)
+}
+
+func checkSTUN(options stun.Options) {
+	result, err := stun.Check(context.Background(), options)
+	if err != nil {
+		logErr.Fatalf("%v", err)
+	}
+	fmt.Println(result.String())
+}
+
+func main() {
+	serverHost := flag.String("host", client.DefaultServer, "server hostname[:port]")
+	ipv6 := flag.Bool("ipv6", false, "also run the test over IPv6")
+	lifetime := flag.Bool("lifetime", false, "also measure the NAT mapping lifetime (can take up to an hour)")
+	refresh := flag.Bool("refresh", false, "also test the NAT mapping refresh behavior, implies -lifetime")
+	pair := flag.Bool("pair", false, "also test hole-punching with another client, which joins with the pairing code printed")
+	join := flag.String("join", "", "also test hole-punching with another client, by joining its pairing code")
+	tcp := flag.Bool("tcp", false, "also test the NAT behavior for TCP connections")
+	stunHost := flag.String("stun", "", "run the tests against an RFC 5780 STUN server hostname[:port] instead")
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS")
+	tlsCA := flag.String("tls-ca", "", "PEM CA file to verify the server certificate with instead of the system CAs, implies -tls")
+	debug := flag.Bool("debug", false, "add debug logging")
+	flag.Parse()
+
+	if *stunHost != "" {
+		options := stun.Options{
+			Server: *stunHost,
+		}
+		if *debug {
+			options.Debug = log.New(os.Stderr, "debug: ", log.Ldate|log.Ltime|log.Lshortfile)
+		}
+		checkSTUN(options)
+		if *ipv6 {
+			options.IPv6 = true
+			checkSTUN(options)
+		}
+		return
+	}
+
+	var message string
+	var pairingCode string
+	options := client.Options{
+		Server:      *serverHost,
+		Lifetime:    *lifetime,
+		Refresh:     *refresh,
+		Pair:        *pair,
+		PairingCode: *join,
+		TCP:         *tcp,
+		Progress: func(p client.Progress) {
+			if p.PairingCode != pairingCode {
+				pairingCode = p.PairingCode
+				if *join == "" {
+					logErr.Printf("Pairing code: %s. Run punch-check -join %s on the other machine.", pairingCode, pairingCode)
+				}
+			}
+			if p.Message != message {
+				message = p.Message
+				logErr.Println(message)
+			}
+		},
+	}
+	if *debug {
+		options.Debug = log.New(os.Stderr, "debug: ", log.Ldate|log.Ltime|log.Lshortfile)
+	}
+	if *useTLS || *tlsCA != "" {
+		config, err := LoadTLSConfig("", "", *tlsCA)
+		if err != nil {
+			logErr.Fatalf("failed loading TLS configuration: %v", err)
+		}
+		options.TLSConfig = config
+	}
+
+	check(options)
+	if *ipv6 {
+		options.IPv6 = true
+		// pairing codes can only be used once
+		options.Pair = false
+		options.PairingCode = ""
+		check(options)
+	}
+}
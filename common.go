@@ -1,6 +1,9 @@
 package punch
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -8,6 +11,8 @@ import (
 	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type MessageType byte
@@ -18,12 +23,52 @@ var (
 	InfoType    MessageType = 2
 	PortsType   MessageType = 3
 	PingType    MessageType = 4
+	ResultType  MessageType = 5
+	HelloType   MessageType = 6
+	PairType    MessageType = 7
+	ConnectType MessageType = 8
+	AcceptType  MessageType = 9
+	AuthType    MessageType = 10
+	SessionType MessageType = 11
+)
+
+// ProtocolVersion is the latest version of the control protocol. Version 0 is
+// the original protocol, in which peers do not send MessageHello.
+var ProtocolVersion = 1
+var MinProtocolVersion = 0
+
+var (
+	FeatureResults    = "results"    // structured results with MessageResult
+	FeatureIPv6       = "ipv6"       // tests over IPv6
+	FeatureLifetime   = "lifetime"   // mapping lifetime test, requested in MessagePorts.Tests
+	FeatureRefresh    = "refresh"    // mapping refresh direction test, requested in MessagePorts.Tests
+	FeaturePairing    = "pairing"    // peer-to-peer hole-punching test between two clients, with MessagePair
+	FeatureRendezvous = "rendezvous" // exchange of the public endpoints of two clients, with MessagePair.Rendezvous
+	FeatureTCP        = "tcp"        // TCP behavior test, requested in MessagePorts.Tests, with MessageConnect and MessageAccept
+	FeatureSessions   = "sessions"   // test sessions opened on relays with MessageSession
+	FeatureHeartbeat  = "heartbeat"  // relay heartbeats with MessagePing
+)
+
+var Features = []string{FeatureResults, FeatureIPv6, FeatureLifetime, FeatureRefresh, FeaturePairing, FeatureRendezvous, FeatureTCP, FeatureSessions, FeatureHeartbeat}
+
+// names of the tests run by servers
+var (
+	TestMapping     = "mapping"     // C* -> A0, C0 -> A1, C0 -> B0
+	TestFiltering   = "filtering"   // A0 -> C1, A1 -> C1, B0 -> C1
+	TestHairpinning = "hairpinning" // C1 <-> C2
+	TestBurst       = "burst"       // mappings created in sequence, for port prediction
+	TestLifetime    = FeatureLifetime
+	TestRefresh     = FeatureRefresh
+	TestPairing     = FeaturePairing
+	TestTCP         = FeatureTCP
 )
 
 type Message interface {
 	Type() MessageType
 }
 
+// MessageInfo.MessageType values: 0 is an error, 1 is the final test results,
+// and 2 is a progress status sent during long tests.
 type MessageInfo struct {
 	MessageType int    `json:"message_type"`
 	Message     string `json:"message"`
@@ -34,7 +79,9 @@ func (m *MessageInfo) Type() MessageType {
 }
 
 type MessagePorts struct {
-	Ports []int `json:"ports"`
+	Ports []int    `json:"ports"`
+	IP    []byte   `json:"ip,omitempty"`    // local IP of the client, if known
+	Tests []string `json:"tests,omitempty"` // optional tests requested by the client
 }
 
 func (m *MessagePorts) Type() MessageType {
@@ -63,18 +110,392 @@ func (m *MessageReceive) Type() MessageType {
 	return ReceiveType
 }
 
+// MessagePing is sent by a client to check that the server is up, to which it
+// replies with a MessageInfo and closes the connection. With FeatureHeartbeat,
+// the server also periodically sends it to relays with an ID, and relays reply
+// with the same message.
 type MessagePing struct {
+	ID int `json:"id,omitempty"`
 }
 
 func (m *MessagePing) Type() MessageType {
 	return PingType
 }
 
-func ReadMessage(c *net.TCPConn) (Message, error) {
+type MessageHello struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Features   []string `json:"features"`
+	// Challenge is sent by servers that require relays to authenticate.
+	// Relays reply with MessageAuth.
+	Challenge []byte `json:"challenge,omitempty"`
+}
+
+func (m *MessageHello) Type() MessageType {
+	return HelloType
+}
+
+// Negotiate returns the protocol version to use with a peer that sent m, given
+// the range of versions supported locally.
+func (m *MessageHello) Negotiate(version int, minVersion int) (int, error) {
+	v := version
+	if m.Version < v {
+		v = m.Version
+	}
+	if v < minVersion || v < m.MinVersion {
+		return 0, fmt.Errorf("incompatible protocol versions: local supports %d to %d, remote supports %d to %d", minVersion, version, m.MinVersion, m.Version)
+	}
+	return v, nil
+}
+
+func (m *MessageHello) Supports(feature string) bool {
+	for _, f := range m.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Pairing is the result of a pairing test, in which both clients send packets
+// from a local port to the public endpoint of the other client.
+type Pairing struct {
+	PeerIP   []byte `json:"peer_ip,omitempty"` // public IP of the peer mapping, nil if the peer did not join
+	PeerPort int    `json:"peer_port,omitempty"`
+	Sent     bool   `json:"sent"`     // packets sent to the peer were received
+	Received bool   `json:"received"` // packets sent by the peer were received
+	// PeerProfile is the result of the test of the peer NAT, if known.
+	PeerProfile *MessageResult `json:"peer_profile,omitempty"`
+}
+
+func (p *Pairing) String() string {
+	if len(p.PeerIP) == 0 {
+		return "Pairing test failed: the peer did not join.\n"
+	}
+	result := func(ok bool) string {
+		if ok {
+			return "succeeded"
+		}
+		return "failed"
+	}
+	peer := net.JoinHostPort(net.IP(p.PeerIP).String(), strconv.Itoa(p.PeerPort))
+	return fmt.Sprintf("Direct connection to the peer at %s: %s.\nDirect connection from the peer: %s.\n", peer, result(p.Sent), result(p.Received))
+}
+
+// MessagePair is sent by a client before MessagePorts to run a pairing test
+// with another client. An empty code creates a new pairing session. The server
+// replies with the code of the session.
+type MessagePair struct {
+	Code string `json:"code"`
+	// Rendezvous only exchanges the public endpoints of the first port of the
+	// clients, without running tests. Clients send a single port.
+	Rendezvous bool `json:"rendezvous,omitempty"`
+	// Profile is the result of a previous test of the client, sent to the peer.
+	Profile *MessageResult `json:"profile,omitempty"`
+}
+
+func (m *MessagePair) Type() MessageType {
+	return PairType
+}
+
+type ConnectResult string
+
+var (
+	ConnectConnected ConnectResult = "connected" // the connection was established
+	ConnectReset     ConnectResult = "reset"     // the connection was refused
+	ConnectTimeout   ConnectResult = "timeout"   // the connection attempt timed out
+	ConnectFailed    ConnectResult = "failed"    // the connection attempt failed locally
+)
+
+// MessageConnect is sent by the server to a client or relay to open a TCP
+// connection from its port LocalPort to IP:Port, and write Data to it. The
+// connection is kept open until the end of the test. The peer replies with the
+// same message, with Result set.
+type MessageConnect struct {
+	ID        int           `json:"id"`
+	LocalPort int           `json:"local_port"`
+	IP        []byte        `json:"ip"`
+	Port      int           `json:"port"`
+	Data      []byte        `json:"data"`
+	Result    ConnectResult `json:"result,omitempty"`
+}
+
+func (m *MessageConnect) Type() MessageType {
+	return ConnectType
+}
+
+// MessageAccept is sent by a relay when it accepts a TCP connection on its
+// port LocalPort from IP:Port, with the data first read from it.
+type MessageAccept struct {
+	LocalPort int    `json:"local_port"`
+	IP        []byte `json:"ip"`
+	Port      int    `json:"port"`
+	Data      []byte `json:"data"`
+}
+
+func (m *MessageAccept) Type() MessageType {
+	return AcceptType
+}
+
+// MessageAuth is sent by a relay after the server hello, to authenticate with
+// the pre-shared relay key.
+type MessageAuth struct {
+	MAC []byte `json:"mac"`
+}
+
+func (m *MessageAuth) Type() MessageType {
+	return AuthType
+}
+
+// RelayMAC returns the MAC of a relay authentication challenge with key.
+func RelayMAC(key []byte, challenge []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("punch-check relay"))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// MessageSession is sent by the server to the relays of a client test, to
+// allow them to send to IP for the test session Session, until the server sends
+// the message with Closed set. Relays only send packets and open connections to
+// the IPs of open sessions.
+type MessageSession struct {
+	Session uint64 `json:"session"`
+	IP      []byte `json:"ip,omitempty"`
+	Closed  bool   `json:"closed,omitempty"`
+}
+
+func (m *MessageSession) Type() MessageType {
+	return SessionType
+}
+
+// TCP is the result of a TCP behavior test, as in RFC 5382.
+type TCP struct {
+	Blocked   bool     `json:"blocked"` // C0 -> A0 failed
+	Mapping   Behavior `json:"mapping,omitempty"`
+	Filtering Behavior `json:"filtering,omitempty"`
+	// Unsolicited is the result of a connection to a NAT port without
+	// mapping: reset if the NAT rejects unsolicited SYNs, timeout if it drops
+	// them.
+	Unsolicited ConnectResult `json:"unsolicited,omitempty"`
+	// HolePunching is whether C2 -> B1 and B1 -> the mapping of C2, opened at
+	// the same time while both ends listen, were both established.
+	HolePunching bool `json:"hole_punching"`
+}
+
+func (t *TCP) String() string {
+	if t.Blocked {
+		return "TCP test failed. TCP connections to the relays are blocked.\n"
+	}
+	message := fmt.Sprintf("TCP filtering: %s.\nTCP mapping: %s.\n", t.Filtering, t.Mapping)
+	switch t.Unsolicited {
+	case ConnectReset:
+		message += "Unsolicited TCP SYNs are rejected.\n"
+	case ConnectTimeout:
+		message += "Unsolicited TCP SYNs are dropped.\n"
+	case ConnectConnected:
+		message += "Unsolicited TCP SYNs are accepted.\n"
+	}
+	if t.HolePunching {
+		message += "TCP hole punching is supported.\n"
+	} else {
+		message += "TCP hole punching is NOT supported.\n"
+	}
+	return message
+}
+
+type Behavior string
+
+var (
+	EndpointIndependent     Behavior = "endpoint-independent"
+	AddressDependent        Behavior = "address-dependent"
+	AddressAndPortDependent Behavior = "address and port-dependent"
+)
+
+type Translation string
+
+var (
+	TranslationNone    Translation = "none"
+	TranslationPrefix  Translation = "prefix translation (NPTv6)"
+	TranslationAddress Translation = "address translation"
+)
+
+// DetectTranslation returns how the IPv6 address localIP was translated to
+// publicIP. IPv6 addresses with the same interface identifier, up to a 16-bit checksum-neutral
+// adjustment, are considered prefix-translated, as in RFC 6296.
+func DetectTranslation(localIP net.IP, publicIP net.IP) Translation {
+	if localIP.Equal(publicIP) {
+		return TranslationNone
+	}
+	if localIP.To4() != nil || publicIP.To4() != nil || len(localIP) != net.IPv6len || len(publicIP) != net.IPv6len {
+		return TranslationAddress
+	}
+	diff := 0
+	for i := 8; i < net.IPv6len; i += 2 {
+		if localIP[i] != publicIP[i] || localIP[i+1] != publicIP[i+1] {
+			diff++
+		}
+	}
+	if diff <= 1 {
+		return TranslationPrefix
+	}
+	return TranslationAddress
+}
+
+type Lifetime struct {
+	Min time.Duration `json:"min"` // the mapping was alive after being idle for Min, 0 if unknown
+	Max time.Duration `json:"max"` // the mapping had expired after being idle for Max, 0 if it never expired
+}
+
+func (l *Lifetime) String() string {
+	if l.Min == 0 {
+		return fmt.Sprintf("less than %v", l.Max)
+	}
+	if l.Max == 0 {
+		return fmt.Sprintf("more than %v", l.Min)
+	}
+	return fmt.Sprintf("between %v and %v", l.Min, l.Max)
+}
+
+type Pooling string
+
+var (
+	PoolingPaired    Pooling = "paired"
+	PoolingArbitrary Pooling = "arbitrary"
+)
+
+type PortPrediction struct {
+	Delta      int     `json:"delta"`      // most frequent delta between the NAT ports of consecutive mappings
+	Mean       float64 `json:"mean"`       // mean of the deltas
+	Variance   float64 `json:"variance"`   // variance of the deltas
+	Confidence float64 `json:"confidence"` // ratio of deltas equal to Delta
+	Samples    int     `json:"samples"`    // number of deltas
+}
+
+func (p *PortPrediction) String() string {
+	return fmt.Sprintf("next port likely = last %+d (%.0f%% confidence); delta mean %.1f, variance %.1f over %d samples", p.Delta, p.Confidence*100, p.Mean, p.Variance, p.Samples)
+}
+
+type MessageResult struct {
+	UDPBlocked          bool            `json:"udp_blocked"`
+	Mapping             Behavior        `json:"mapping,omitempty"`
+	Filtering           Behavior        `json:"filtering,omitempty"`
+	Hairpinning         bool            `json:"hairpinning"`
+	PreservesParity     bool            `json:"preserves_parity"`
+	PreservesPort       bool            `json:"preserves_port"`
+	PreservesContiguity bool            `json:"preserves_contiguity"`
+	IP                  []byte          `json:"ip"`     // public IP of the control connection
+	UDPIP               []byte          `json:"udp_ip"` // public IP of the first UDP mapping
+	Pooling             Pooling         `json:"pooling,omitempty"`
+	LocalIP             []byte          `json:"local_ip,omitempty"`
+	Translation         Translation     `json:"translation,omitempty"`
+	Ports               []int           `json:"ports"`
+	NATPorts            []int           `json:"nat_ports"`
+	BurstPorts          []int           `json:"burst_ports,omitempty"`
+	BurstNATPorts       []int           `json:"burst_nat_ports,omitempty"` // NAT ports of mappings created in sequence
+	PortPrediction      *PortPrediction `json:"port_prediction,omitempty"`
+	Confidence          *Confidence     `json:"confidence,omitempty"`
+	MappingLifetime     *Lifetime       `json:"mapping_lifetime,omitempty"`
+	OutboundRefresh     *bool           `json:"outbound_refresh,omitempty"`
+	InboundRefresh      *bool           `json:"inbound_refresh,omitempty"`
+	Untested            []string        `json:"untested,omitempty"` // tests disabled on the server
+	Pairing             *Pairing        `json:"pairing,omitempty"`
+	TCP                 *TCP            `json:"tcp,omitempty"`
+}
+
+// Confidence is the consistency of the observations of the mapping and
+// filtering verdicts, over the ports of the relays used in the test.
+type Confidence struct {
+	Mapping    float64 `json:"mapping"`   // ratio of observations consistent with the mapping verdict
+	Filtering  float64 `json:"filtering"` // ratio of observations consistent with the filtering verdict
+	Relays     int     `json:"relays"`
+	RelayPorts int     `json:"relay_ports"`
+}
+
+func (c *Confidence) String() string {
+	return fmt.Sprintf("mapping %.0f%% confidence, filtering %.0f%% confidence over %d relays with %d ports", c.Mapping*100, c.Filtering*100, c.Relays, c.RelayPorts)
+}
+
+func (m *MessageResult) Type() MessageType {
+	return ResultType
+}
+
+func (m *MessageResult) IPv6() bool {
+	return len(m.IP) > 0 && net.IP(m.IP).To4() == nil
+}
+
+func (m *MessageResult) HolePunching() bool {
+	return !m.UDPBlocked && m.Mapping == EndpointIndependent
+}
+
+func (m *MessageResult) String() string {
+	test := "Test"
+	if m.IPv6() {
+		test = "IPv6 test"
+	}
+	if m.UDPBlocked {
+		return test + " failed. UDP is blocked."
+	}
+	message := test + " complete.\n"
+	if m.HolePunching() {
+		message += "Hole-punching is supported.\n"
+	} else {
+		message += "Hole-punching is NOT supported.\n"
+	}
+	message += fmt.Sprintf("Filtering: %s.\nMapping: %s.\n", m.Filtering, m.Mapping)
+	if m.Confidence != nil && (m.Confidence.Mapping < 1 || m.Confidence.Filtering < 1) {
+		message += fmt.Sprintf("Inconsistent observations, the NAT may be load-balanced or lossy: %s.\n", m.Confidence)
+	}
+	if m.Pooling != "" {
+		message += fmt.Sprintf("Address pooling: %s.\n", m.Pooling)
+	}
+	if len(m.UDPIP) > 0 && !net.IP(m.UDPIP).Equal(m.IP) {
+		message += fmt.Sprintf("UDP public IP %s differs from TCP public IP %s.\n", net.IP(m.UDPIP), net.IP(m.IP))
+	}
+	if m.Translation != "" {
+		message += fmt.Sprintf("Address translation: %s.\n", m.Translation)
+	}
+	if m.Hairpinning {
+		message += "Hairpinning is supported.\n"
+	}
+	if m.PreservesParity {
+		message += "Assignment preserves parity.\n"
+	}
+	if m.PreservesPort {
+		message += "Assignment preserves local port.\n"
+	}
+	if m.PreservesContiguity {
+		message += "Assignment preserves contiguity.\n"
+	}
+	if m.PortPrediction != nil {
+		message += fmt.Sprintf("Port prediction: %s.\n", m.PortPrediction)
+	}
+	if m.MappingLifetime != nil {
+		message += fmt.Sprintf("Mapping lifetime: %s.\n", m.MappingLifetime)
+	}
+	if m.OutboundRefresh != nil {
+		message += fmt.Sprintf("NAT outbound refresh behavior: %t.\n", *m.OutboundRefresh)
+	}
+	if m.InboundRefresh != nil {
+		message += fmt.Sprintf("NAT inbound refresh behavior: %t.\n", *m.InboundRefresh)
+	}
+	if m.Pairing != nil {
+		message += m.Pairing.String()
+	}
+	if m.TCP != nil {
+		message += m.TCP.String()
+	}
+	if len(m.Untested) > 0 {
+		message += fmt.Sprintf("Not tested by the server: %s.\n", strings.Join(m.Untested, ", "))
+	}
+	return message
+}
+
+func ReadMessage(c io.Reader) (Message, error) {
 	header := make([]byte, 3)
 	_, err := io.ReadFull(c, header)
 	if err != nil {
-		return nil, fmt.Errorf("reading message header: read error: %v", err)
+		return nil, fmt.Errorf("reading message header: read error: %w", err)
 	}
 	mt := header[0]
 	ml := int64(binary.BigEndian.Uint16(header[1:]))
@@ -90,6 +511,20 @@ func ReadMessage(c *net.TCPConn) (Message, error) {
 		m = &MessagePorts{}
 	case PingType:
 		m = &MessagePing{}
+	case ResultType:
+		m = &MessageResult{}
+	case HelloType:
+		m = &MessageHello{}
+	case PairType:
+		m = &MessagePair{}
+	case ConnectType:
+		m = &MessageConnect{}
+	case AcceptType:
+		m = &MessageAccept{}
+	case AuthType:
+		m = &MessageAuth{}
+	case SessionType:
+		m = &MessageSession{}
 	default:
 		return nil, fmt.Errorf("reading message: unknown message type: %v", MessageType(mt))
 	}
@@ -107,7 +542,7 @@ func ReadMessage(c *net.TCPConn) (Message, error) {
 	return m, nil
 }
 
-func WriteMessage(c *net.TCPConn, m Message) error {
+func WriteMessage(c io.Writer, m Message) error {
 	header := make([]byte, 3)
 	header[0] = byte(m.Type())
 	data, err := json.Marshal(m)
@@ -124,6 +559,27 @@ func WriteMessage(c *net.TCPConn, m Message) error {
 	return nil
 }
 
+// Transport creates the network connections of clients and relays, so that
+// they can run on networks other than the system network stack.
+type Transport interface {
+	Dial(ctx context.Context, network string, address string) (net.Conn, error)
+	ListenPacket(network string, address string) (net.PacketConn, error)
+}
+
+type netTransport struct{}
+
+func (netTransport) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (netTransport) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+// NetTransport is the Transport of the system network stack.
+var NetTransport Transport = netTransport{}
+
 func Index(a []int, e int) int {
 	for i, v := range a {
 		if v == e {
@@ -133,7 +589,7 @@ func Index(a []int, e int) int {
 	return -1
 }
 
-func ResolveTCPBySRV(service string, host string) (*net.TCPAddr, error) {
+func ResolveTCPBySRV(network string, service string, host string) (*net.TCPAddr, error) {
 	_, srvs, err := net.LookupSRV(service, "tcp", host)
 	if err != nil {
 		return nil, fmt.Errorf("resolving service %q of host %q: %v", service, host, err)
@@ -144,7 +600,7 @@ func ResolveTCPBySRV(service string, host string) (*net.TCPAddr, error) {
 	var lastRecord string
 	for _, srv := range srvs {
 		var addr *net.TCPAddr
-		addr, err = net.ResolveTCPAddr("tcp4", net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+		addr, err = net.ResolveTCPAddr(network, net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
 		if err != nil {
 			lastRecord = srv.Target
 			continue
@@ -168,3 +624,6 @@ func (v *StringSliceFlag) Set(s string) error {
 var ClientRelaysCount = 2
 var ClientPortsCount = 5
 var RelayPortsCount = 2
+
+// TCPConnectTimeout is the timeout of TCP connection attempts of the TCP test.
+var TCPConnectTimeout = 5 * time.Second
@@ -5,6 +5,6 @@ go 1.13
 require (
 	github.com/lxn/walk v0.0.0-20191128110447-55ccb3a9f5c1
 	github.com/lxn/win v0.0.0-20191128105842-2da648fda5b4 // indirect
-	golang.org/x/sys v0.0.0-20200406155108-e3b113bbe6a4 // indirect
+	golang.org/x/sys v0.0.0-20200406155108-e3b113bbe6a4
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
 )
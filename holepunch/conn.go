@@ -0,0 +1,64 @@
+package holepunch
+
+import (
+	"net"
+	"time"
+)
+
+// Conn is a connected UDP flow to a peer, over a punched hole. Reads drop
+// packets from other addresses, and acknowledge the punch packets the peer
+// may still send.
+type Conn struct {
+	c      net.PacketConn
+	remote *net.UDPAddr
+	code   string
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		n, a, err := c.c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		addr, ok := a.(*net.UDPAddr)
+		if !ok || !addr.IP.Equal(c.remote.IP) || addr.Port != c.remote.Port {
+			continue
+		}
+		if t, ok := parsePunch(b[:n], c.code); ok {
+			if t == punchSyn {
+				c.c.WriteTo(punchPacket(punchAck, c.code), c.remote)
+			}
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.c.WriteTo(b, c.remote)
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.c.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
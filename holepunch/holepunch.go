@@ -0,0 +1,331 @@
+// Package holepunch establishes direct UDP flows between two clients behind
+// NATs, using a punch-check server for rendezvous.
+//
+// Both clients connect to the server with the same pairing code, and the
+// server tells each client the public endpoint of the other. Both clients
+// then send punch packets to the endpoint of the other until a packet in
+// each direction was received. If the NAT profile of the peer reports an
+// address-dependent mapping with predictable port assignment, packets are
+// also sent to the ports the peer NAT is predicted to assign.
+package holepunch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+)
+
+var DefaultTimeout = 10 * time.Second
+
+// minProtocolVersion is the minimum protocol version of the server, which
+// must send MessageHello
+var minProtocolVersion = 1
+
+var punchInterval = 100 * time.Millisecond
+
+// predictionCount is the number of predicted ports tried for peers with an
+// address-dependent mapping
+var predictionCount = 8
+
+// predictionConfidence is the minimum confidence of a port prediction to try
+// predicted ports
+var predictionConfidence = 0.5
+
+type Options struct {
+	// Server is the server hostname[:port]. If no port is given, the server
+	// address is resolved with an SRV lookup. Defaults to client.DefaultServer.
+	Server string
+	// Code is the pairing code to join. If empty, a pairing session is created
+	// and its code is passed to OnCode, for the peer to join.
+	Code string
+	// OnCode, if set, is called with the code of the pairing session.
+	OnCode func(code string)
+	// Profile is the result of a previous test of the local NAT, for example
+	// from client.Check. It is sent to the peer for port prediction.
+	Profile *MessageResult
+	// Timeout is the duration of hole punching, after rendezvous. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+	// Transport, if set, creates the control connection. Defaults to
+	// NetTransport.
+	Transport Transport
+	// TLSConfig, if set, is used to connect to the server over TLS.
+	TLSConfig *tls.Config
+	// Debug, if set, receives debug logs.
+	Debug *log.Logger
+}
+
+// Peer is the peer of a pairing session, as seen by the server.
+type Peer struct {
+	Addr    *net.UDPAddr   // public endpoint of the peer
+	Profile *MessageResult // NAT profile of the peer, if it sent it
+}
+
+// Punch meets a peer through the server, then punches a hole to it from c,
+// and returns a connection to the peer over c. c must not be read from
+// concurrently while Punch runs.
+func Punch(ctx context.Context, c net.PacketConn, options Options) (*Conn, error) {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Debug == nil {
+		options.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	peer, code, err := Rendezvous(ctx, c, options)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+	return punch(ctx, c, peer, code, options.Debug)
+}
+
+// Rendezvous joins or creates a pairing session on the server, and returns the
+// peer and the code of the session once the peer joined. The public endpoint
+// of c is sent to the peer.
+func Rendezvous(ctx context.Context, c net.PacketConn, options Options) (*Peer, string, error) {
+	if options.Server == "" {
+		options.Server = client.DefaultServer
+	}
+	if options.Transport == nil {
+		options.Transport = NetTransport
+	}
+	if options.Debug == nil {
+		options.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	localAddr, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, "", fmt.Errorf("invalid local address type: %T", c.LocalAddr())
+	}
+	network := "tcp4"
+	if localAddr.IP != nil && localAddr.IP.To4() == nil {
+		network = "tcp6"
+	}
+
+	var serverAddr *net.TCPAddr
+	_, _, err := net.SplitHostPort(options.Server)
+	if err != nil {
+		serverAddr, err = ResolveTCPBySRV(network, "punchcheck", options.Server)
+	} else {
+		serverAddr, err = net.ResolveTCPAddr(network, options.Server)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("resolving server host %q: %v", options.Server, err)
+	}
+	control, err := options.Transport.Dial(ctx, network, serverAddr.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("dialing server at %q: %v", options.Server, err)
+	}
+	if options.TLSConfig != nil {
+		control = TLSClient(control, options.TLSConfig, options.Server)
+	}
+	defer control.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			control.Close()
+		case <-done:
+		}
+	}()
+
+	for _, m := range []Message{
+		&MessageHello{
+			Version:    ProtocolVersion,
+			MinVersion: minProtocolVersion,
+			Features:   Features,
+		},
+		&MessagePair{
+			Code:       options.Code,
+			Rendezvous: true,
+			Profile:    options.Profile,
+		},
+		&MessagePorts{
+			Ports: []int{localAddr.Port},
+		},
+	} {
+		if err := WriteMessage(control, m); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var hello *MessageHello
+	var code string
+	for {
+		m, err := ReadMessage(control)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			return nil, "", fmt.Errorf("reading message from control socket: %v", err)
+		}
+		if _, ok := m.(*MessageHello); !ok && hello == nil {
+			if m, ok := m.(*MessageInfo); ok && m.MessageType == 0 {
+				return nil, "", &client.ServerError{Message: m.Message}
+			}
+			return nil, "", fmt.Errorf("invalid handshake: unexpected message type: %v", MessageType(m.Type()))
+		}
+		switch m := m.(type) {
+		case *MessageHello:
+			if hello != nil {
+				return nil, "", fmt.Errorf("invalid handshake: duplicate hello message")
+			}
+			if _, err := m.Negotiate(ProtocolVersion, minProtocolVersion); err != nil {
+				return nil, "", fmt.Errorf("invalid handshake: %v", err)
+			}
+			if !m.Supports(FeatureRendezvous) {
+				return nil, "", fmt.Errorf("server does not support rendezvous")
+			}
+			hello = m
+		case *MessagePair:
+			code = m.Code
+			if options.Code == "" && options.OnCode != nil {
+				options.OnCode(code)
+			}
+		case *MessageSend:
+			if m.LocalPort != localAddr.Port {
+				return nil, "", fmt.Errorf("invalid send message: invalid local port: %d", m.LocalPort)
+			}
+			options.Debug.Printf("writing to %s:%d from %d: %v", net.IP(m.IP).String(), m.Port, m.LocalPort, m.Data)
+			c.WriteTo(m.Data, &net.UDPAddr{
+				IP:   m.IP,
+				Port: m.Port,
+			})
+		case *MessageInfo:
+			if m.MessageType == 0 {
+				return nil, "", &client.ServerError{Message: m.Message}
+			}
+			options.Debug.Printf("server message: %s", m.Message)
+		case *MessageResult:
+			if m.Pairing == nil || len(m.Pairing.PeerIP) == 0 {
+				return nil, "", fmt.Errorf("peer did not join the pairing session")
+			}
+			return &Peer{
+				Addr: &net.UDPAddr{
+					IP:   m.Pairing.PeerIP,
+					Port: m.Pairing.PeerPort,
+				},
+				Profile: m.Pairing.PeerProfile,
+			}, code, nil
+		default:
+			return nil, "", fmt.Errorf("invalid message type: %v", MessageType(m.Type()))
+		}
+	}
+}
+
+// Candidates returns the addresses to send punch packets to, to reach peer.
+func Candidates(peer *Peer) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{peer.Addr}
+	profile := peer.Profile
+	if profile == nil || profile.Mapping == "" || profile.Mapping == EndpointIndependent {
+		return addrs
+	}
+	prediction := profile.PortPrediction
+	if prediction == nil || prediction.Delta == 0 || prediction.Confidence < predictionConfidence {
+		return addrs
+	}
+	// the peer NAT creates a new mapping to reach us, with one of the next ports
+	for i := 1; i <= predictionCount; i++ {
+		port := peer.Addr.Port + i*prediction.Delta
+		if port <= 0 || port > 65535 {
+			break
+		}
+		addrs = append(addrs, &net.UDPAddr{
+			IP:   peer.Addr.IP,
+			Port: port,
+		})
+	}
+	return addrs
+}
+
+const (
+	punchSyn byte = iota
+	punchAck
+)
+
+var punchMagic = []byte("punch-check")
+
+func punchPacket(t byte, code string) []byte {
+	data := make([]byte, 0, len(punchMagic)+1+len(code))
+	data = append(data, punchMagic...)
+	data = append(data, t)
+	data = append(data, code...)
+	return data
+}
+
+// parsePunch returns the type of a punch packet of the session code.
+func parsePunch(data []byte, code string) (byte, bool) {
+	if len(data) != len(punchMagic)+1+len(code) || !bytes.HasPrefix(data, punchMagic) {
+		return 0, false
+	}
+	if string(data[len(punchMagic)+1:]) != code {
+		return 0, false
+	}
+	t := data[len(punchMagic)]
+	return t, t == punchSyn || t == punchAck
+}
+
+func punch(ctx context.Context, c net.PacketConn, peer *Peer, code string, debug *log.Logger) (*Conn, error) {
+	defer c.SetReadDeadline(time.Time{})
+	addrs := Candidates(peer)
+	syn := punchPacket(punchSyn, code)
+	ack := punchPacket(punchAck, code)
+	deadline, _ := ctx.Deadline()
+	next := time.Now()
+	buf := make([]byte, 1536)
+	for {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("punching hole to %v: %v", peer.Addr, ctx.Err())
+		}
+		if now := time.Now(); !now.Before(next) {
+			for _, addr := range addrs {
+				debug.Printf("sending punch packet to %v", addr)
+				c.WriteTo(syn, addr)
+			}
+			next = now.Add(punchInterval)
+		}
+		readDeadline := next
+		if !deadline.IsZero() && deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		c.SetReadDeadline(readDeadline)
+		n, a, err := c.ReadFrom(buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			}
+			return nil, fmt.Errorf("reading from UDP socket: %v", err)
+		}
+		addr, ok := a.(*net.UDPAddr)
+		if !ok || !addr.IP.Equal(peer.Addr.IP) {
+			continue
+		}
+		t, ok := parsePunch(buf[:n], code)
+		if !ok {
+			continue
+		}
+		switch t {
+		case punchSyn:
+			debug.Printf("received punch packet from %v", addr)
+			c.WriteTo(ack, addr)
+		case punchAck:
+			debug.Printf("received punch acknowledgement from %v", addr)
+			// the peer may not have received our acknowledgement yet
+			c.WriteTo(ack, addr)
+			return &Conn{
+				c:      c,
+				remote: addr,
+				code:   code,
+			}, nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package holepunch_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/holepunch"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+)
+
+func TestHolePunch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	portRestricted := netsim.NATConfig{
+		Filtering: AddressAndPortDependent,
+	}
+	sequential := netsim.NATConfig{
+		Mapping:    AddressAndPortDependent,
+		Filtering:  AddressAndPortDependent,
+		Allocation: netsim.AllocationSequential,
+		BasePort:   20001,
+		Delta:      1,
+	}
+	tests := []struct {
+		name    string
+		configs [2]netsim.NATConfig
+	}{
+		{"port restricted cones", [2]netsim.NATConfig{portRestricted, portRestricted}},
+		{"predictable symmetric and port restricted cone", [2]netsim.NATConfig{sequential, portRestricted}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			n := netsim.New(1)
+			netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+			hosts := [2]*netsim.Host{
+				n.AddHost("192.168.0.2", n.AddNAT(test.configs[0], "5.0.0.1")),
+				n.AddHost("192.168.1.2", n.AddNAT(test.configs[1], "6.0.0.1")),
+			}
+			var profiles [2]*MessageResult
+			for i, h := range hosts {
+				var err error
+				profiles[i], err = netsimtest.Check(ctx, client.Options{
+					Transport: h,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			codes := make(chan string, 1)
+			var conns [2]*holepunch.Conn
+			errs := make(chan error, 2)
+			for i := range hosts {
+				i := i
+				go func() {
+					c, err := hosts[i].ListenPacket("udp4", ":0")
+					if err != nil {
+						errs <- err
+						return
+					}
+					options := holepunch.Options{
+						Server:    netsimtest.ServerAddress,
+						Profile:   profiles[i],
+						Transport: hosts[i],
+					}
+					if i == 0 {
+						options.OnCode = func(code string) {
+							codes <- code
+						}
+					} else {
+						select {
+						case options.Code = <-codes:
+						case <-ctx.Done():
+							errs <- ctx.Err()
+							return
+						}
+					}
+					conns[i], err = holepunch.Punch(ctx, c, options)
+					errs <- err
+				}()
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer conns[0].Close()
+			defer conns[1].Close()
+
+			for i, c := range conns {
+				data := []byte(fmt.Sprintf("hello from %d", i))
+				if _, err := c.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				peer := conns[1-i]
+				peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, 1024)
+				n, err := peer.Read(buf)
+				if err != nil {
+					t.Fatalf("client %d: reading from peer: %v", 1-i, err)
+				}
+				if string(buf[:n]) != string(data) {
+					t.Errorf("client %d: expected %q, got %q", 1-i, data, buf[:n])
+				}
+			}
+		})
+	}
+}
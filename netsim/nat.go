@@ -0,0 +1,234 @@
+package netsim
+
+import (
+	"net"
+	"time"
+
+	"github.com/delthas/punch-check"
+)
+
+type Allocation int
+
+const (
+	// AllocationPreserve uses the internal port if it is free, and allocates
+	// sequentially otherwise.
+	AllocationPreserve Allocation = iota
+	// AllocationSequential allocates ports from NATConfig.BasePort, in steps
+	// of NATConfig.Delta.
+	AllocationSequential
+	// AllocationRandom allocates random ports.
+	AllocationRandom
+)
+
+type NATConfig struct {
+	Mapping     punch.Behavior // defaults to endpoint-independent
+	Filtering   punch.Behavior // defaults to endpoint-independent
+	Hairpinning bool
+	Allocation  Allocation
+	BasePort    int // first port of sequential allocations, defaults to 20000
+	Delta       int // delta of sequential allocations, defaults to 1
+	// Pooling is the IP address pooling behaviour when the NAT has several
+	// public IPs. Defaults to paired.
+	Pooling punch.Pooling
+	// Loss is the probability of dropping each packet going through the NAT.
+	Loss float64
+	// Timeout is the idle duration after which mappings expire, or 0 for
+	// mappings that never expire.
+	Timeout time.Duration
+	// InboundRefresh is whether inbound packets refresh mappings.
+	InboundRefresh bool
+}
+
+type mapping struct {
+	network  string // udp or tcp
+	internal *net.UDPAddr
+	external *net.UDPAddr
+	remotes  map[string]struct{} // IPs and IP:ports the mapping sent packets to
+	last     time.Time
+}
+
+// NAT is a simulated NAT of a Network.
+type NAT struct {
+	network   *Network
+	config    NATConfig
+	publicIPs []net.IP
+	mappings  map[string]*mapping // by mapping key
+	external  map[string]*mapping // by network and external address
+	paired    map[string]net.IP   // public IP of each internal IP
+	next      int                 // next sequential port
+	nextIP    int                 // next public IP for arbitrary pooling
+}
+
+func newNAT(network *Network, config NATConfig, publicIPs []string) *NAT {
+	if config.Mapping == "" {
+		config.Mapping = punch.EndpointIndependent
+	}
+	if config.Filtering == "" {
+		config.Filtering = punch.EndpointIndependent
+	}
+	if config.Pooling == "" {
+		config.Pooling = punch.PoolingPaired
+	}
+	if config.BasePort == 0 {
+		config.BasePort = 20000
+	}
+	if config.Delta == 0 {
+		config.Delta = 1
+	}
+	nat := &NAT{
+		network:  network,
+		config:   config,
+		mappings: make(map[string]*mapping),
+		external: make(map[string]*mapping),
+		paired:   make(map[string]net.IP),
+		next:     config.BasePort,
+	}
+	for _, ip := range publicIPs {
+		nat.publicIPs = append(nat.publicIPs, parseIP(ip))
+	}
+	return nat
+}
+
+func (nat *NAT) owns(ip net.IP) bool {
+	for _, publicIP := range nat.publicIPs {
+		if publicIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (nat *NAT) pairedIP(internal net.IP) net.IP {
+	ip, ok := nat.paired[internal.String()]
+	if !ok {
+		ip = nat.publicIPs[len(nat.paired)%len(nat.publicIPs)]
+		nat.paired[internal.String()] = ip
+	}
+	return ip
+}
+
+func (nat *NAT) mappingKey(network string, src *net.UDPAddr, dst *net.UDPAddr) string {
+	switch nat.config.Mapping {
+	case punch.AddressDependent:
+		return network + "/" + src.String() + "/" + dst.IP.String()
+	case punch.AddressAndPortDependent:
+		return network + "/" + src.String() + "/" + dst.String()
+	default:
+		return network + "/" + src.String()
+	}
+}
+
+func externalKey(network string, external *net.UDPAddr) string {
+	return network + "/" + external.String()
+}
+
+func (nat *NAT) expired(m *mapping, now time.Time) bool {
+	return nat.config.Timeout != 0 && now.Sub(m.last) > nat.config.Timeout
+}
+
+func (nat *NAT) remove(key string, m *mapping) {
+	delete(nat.mappings, key)
+	delete(nat.external, externalKey(m.network, m.external))
+}
+
+func (nat *NAT) allocate(network string, internal *net.UDPAddr) *net.UDPAddr {
+	var ip net.IP
+	if nat.config.Pooling == punch.PoolingArbitrary {
+		ip = nat.publicIPs[nat.nextIP%len(nat.publicIPs)]
+		nat.nextIP++
+	} else {
+		ip = nat.pairedIP(internal.IP)
+	}
+	used := func(port int) bool {
+		_, ok := nat.external[externalKey(network, &net.UDPAddr{IP: ip, Port: port})]
+		return ok
+	}
+	if nat.config.Allocation == AllocationPreserve && !used(internal.Port) {
+		return &net.UDPAddr{IP: ip, Port: internal.Port}
+	}
+	for i := 0; i < 65536; i++ {
+		var port int
+		if nat.config.Allocation == AllocationRandom {
+			port = 1024 + nat.network.rand.Intn(65536-1024)
+		} else {
+			port = nat.next
+			nat.next += nat.config.Delta
+			if nat.next > 65535 {
+				nat.next = 1024 + nat.next%65536
+			}
+		}
+		if !used(port) {
+			return &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	return nil
+}
+
+// outbound translates the source of a packet or TCP connection from the
+// private network, and returns nil if it is dropped. Mappings of network, udp
+// or tcp, are independent of mappings of the other network.
+func (nat *NAT) outbound(network string, src *net.UDPAddr, dst *net.UDPAddr) *net.UDPAddr {
+	if nat.network.lost(nat.config.Loss) {
+		return nil
+	}
+	now := time.Now()
+	key := nat.mappingKey(network, src, dst)
+	m, ok := nat.mappings[key]
+	if ok && nat.expired(m, now) {
+		nat.remove(key, m)
+		ok = false
+	}
+	if !ok {
+		external := nat.allocate(network, src)
+		if external == nil {
+			return nil
+		}
+		m = &mapping{
+			network:  network,
+			internal: src,
+			external: external,
+			remotes:  make(map[string]struct{}),
+		}
+		nat.mappings[key] = m
+		nat.external[externalKey(network, external)] = m
+	}
+	m.remotes[dst.IP.String()] = struct{}{}
+	m.remotes[dst.String()] = struct{}{}
+	m.last = now
+	return m.external
+}
+
+// inbound translates the destination of a packet or TCP connection to a public
+// IP of the NAT, and returns nil if it is dropped.
+func (nat *NAT) inbound(network string, src *net.UDPAddr, dst *net.UDPAddr) *net.UDPAddr {
+	if nat.network.lost(nat.config.Loss) {
+		return nil
+	}
+	now := time.Now()
+	m, ok := nat.external[externalKey(network, dst)]
+	if !ok {
+		return nil
+	}
+	if nat.expired(m, now) {
+		for key, km := range nat.mappings {
+			if km == m {
+				nat.remove(key, m)
+			}
+		}
+		return nil
+	}
+	switch nat.config.Filtering {
+	case punch.AddressDependent:
+		if _, ok := m.remotes[src.IP.String()]; !ok {
+			return nil
+		}
+	case punch.AddressAndPortDependent:
+		if _, ok := m.remotes[src.String()]; !ok {
+			return nil
+		}
+	}
+	if nat.config.InboundRefresh {
+		m.last = now
+	}
+	return m.internal
+}
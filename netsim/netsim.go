@@ -0,0 +1,437 @@
+// Package netsim implements an in-process virtual IPv4 and IPv6 network, with
+// hosts that can be placed behind simulated NATs, so that clients, relays and
+// servers can be tested without a real network.
+package netsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("netsim: use of closed connection")
+
+// ErrTimeout is returned by reads whose deadline passed. It implements
+// net.Error.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "netsim: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Network is a virtual network of hosts and NATs. Its zero value is not
+// usable, use New.
+type Network struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+	hosts map[string]*Host
+	nats  map[string]*NAT // by public IP
+}
+
+// New returns a network whose random decisions (packet loss, random port
+// allocation) are derived from seed.
+func New(seed int64) *Network {
+	return &Network{
+		rand:  rand.New(rand.NewSource(seed)),
+		hosts: make(map[string]*Host),
+		nats:  make(map[string]*NAT),
+	}
+}
+
+// AddHost adds a host with the given IP, which must be unique in the network,
+// even for hosts in private networks. If nat is not nil, the host is in the
+// private network of nat, otherwise it is directly reachable.
+func (n *Network) AddHost(ip string, nat *NAT) *Host {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	h := &Host{
+		network:   n,
+		ip:        parseIP(ip),
+		nat:       nat,
+		conns:     make(map[int]*PacketConn),
+		listeners: make(map[int]*listener),
+		nextPort:  49152,
+	}
+	n.hosts[h.ip.String()] = h
+	return h
+}
+
+// AddNAT adds a NAT with the given configuration and public IPs.
+func (n *Network) AddNAT(config NATConfig, publicIPs ...string) *NAT {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	nat := newNAT(n, config, publicIPs)
+	for _, ip := range nat.publicIPs {
+		n.nats[ip.String()] = nat
+	}
+	return nat
+}
+
+func (n *Network) lost(loss float64) bool {
+	return loss > 0 && n.rand.Float64() < loss
+}
+
+// send routes a packet from a host port. It must be called with n.mutex held.
+func (n *Network) send(from *Host, port int, dst *net.UDPAddr, data []byte) {
+	src := &net.UDPAddr{IP: from.ip, Port: port}
+	if from.nat != nil {
+		nat := from.nat
+		src = nat.outbound("udp", src, dst)
+		if src == nil {
+			return
+		}
+		if nat.owns(dst.IP) {
+			if !nat.config.Hairpinning {
+				return
+			}
+			if internal := nat.inbound("udp", src, dst); internal != nil {
+				n.deliverHost(src, internal, data)
+			}
+			return
+		}
+	}
+	n.deliver(src, dst, data)
+}
+
+func (n *Network) deliver(src *net.UDPAddr, dst *net.UDPAddr, data []byte) {
+	if nat, ok := n.nats[dst.IP.String()]; ok {
+		internal := nat.inbound("udp", src, dst)
+		if internal == nil {
+			return
+		}
+		dst = internal
+	}
+	n.deliverHost(src, dst, data)
+}
+
+func (n *Network) deliverHost(src *net.UDPAddr, dst *net.UDPAddr, data []byte) {
+	h, ok := n.hosts[dst.IP.String()]
+	if !ok {
+		return
+	}
+	c, ok := h.conns[dst.Port]
+	if !ok {
+		return
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case c.packets <- packet{addr: src, data: buf}:
+	default: // queue full: drop
+	}
+}
+
+// Host is a machine of a Network. It implements punch.TCPTransport.
+type Host struct {
+	network   *Network
+	ip        net.IP
+	nat       *NAT
+	conns     map[int]*PacketConn
+	listeners map[int]*listener
+	nextPort  int
+}
+
+func (h *Host) IP() net.IP {
+	return h.ip
+}
+
+// publicIP returns the IP of TCP connections of the host, as seen from
+// public hosts.
+func (h *Host) publicIP() net.IP {
+	if h.nat == nil {
+		return h.ip
+	}
+	return h.nat.pairedIP(h.ip)
+}
+
+func (h *Host) allocatePort(used func(port int) bool) (int, error) {
+	for i := 0; i < 16384; i++ {
+		port := h.nextPort
+		h.nextPort++
+		if h.nextPort > 65535 {
+			h.nextPort = 49152
+		}
+		if !used(port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("netsim: no free port on %v", h.ip)
+}
+
+// checkNetwork returns an error if network is not one of protocols, or is
+// restricted to the other address family than the host IP.
+func (h *Host) checkNetwork(network string, protocols ...string) error {
+	for _, protocol := range protocols {
+		switch network {
+		case protocol:
+			return nil
+		case protocol + "4":
+			if h.ip.To4() == nil {
+				return fmt.Errorf("netsim: network %q unavailable on host %v", network, h.ip)
+			}
+			return nil
+		case protocol + "6":
+			if h.ip.To4() != nil {
+				return fmt.Errorf("netsim: network %q unavailable on host %v", network, h.ip)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("netsim: unsupported network: %q", network)
+}
+
+func (h *Host) parseAddress(network string, address string) (int, error) {
+	if err := h.checkNetwork(network, "udp", "tcp"); err != nil {
+		return 0, err
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil || !(ip.IsUnspecified() || ip.Equal(h.ip)) {
+			return 0, fmt.Errorf("netsim: cannot assign address %q on host %v", address, h.ip)
+		}
+	}
+	return strconv.Atoi(portStr)
+}
+
+func (h *Host) ListenPacket(network string, address string) (net.PacketConn, error) {
+	port, err := h.parseAddress(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.network.mutex.Lock()
+	defer h.network.mutex.Unlock()
+	if port == 0 {
+		port, err = h.allocatePort(func(port int) bool {
+			_, ok := h.conns[port]
+			return ok
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if _, ok := h.conns[port]; ok {
+		return nil, fmt.Errorf("netsim: address %v:%d already in use", h.ip, port)
+	}
+	c := &PacketConn{
+		host:    h,
+		port:    port,
+		packets: make(chan packet, 1024),
+		closed:  make(chan struct{}),
+	}
+	h.conns[port] = c
+	return c, nil
+}
+
+func (h *Host) Listen(network string, address string) (net.Listener, error) {
+	port, err := h.parseAddress(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.network.mutex.Lock()
+	defer h.network.mutex.Unlock()
+	if _, ok := h.listeners[port]; ok || port == 0 {
+		return nil, fmt.Errorf("netsim: cannot listen on %v:%d", h.ip, port)
+	}
+	l := &listener{
+		host:   h,
+		addr:   &net.TCPAddr{IP: h.ip, Port: port},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	h.listeners[port] = l
+	return l, nil
+}
+
+// Dial opens a reliable stream connection to a listener. NATs translate the
+// source IP of connections but do not filter them.
+func (h *Host) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if err := h.checkNetwork(network, "tcp"); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	h.network.mutex.Lock()
+	var l *listener
+	if target, ok := h.network.hosts[addr.IP.String()]; ok {
+		l = target.listeners[addr.Port]
+	}
+	port, err := h.allocatePort(func(int) bool { return false })
+	publicIP := h.publicIP()
+	h.network.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, fmt.Errorf("netsim: dial %v: connection refused", address)
+	}
+
+	local, remote := net.Pipe()
+	localConn := &conn{
+		Conn:   local,
+		local:  &net.TCPAddr{IP: h.ip, Port: port},
+		remote: l.addr,
+	}
+	remoteConn := &conn{
+		Conn:   remote,
+		local:  l.addr,
+		remote: &net.TCPAddr{IP: publicIP, Port: port},
+	}
+	select {
+	case l.conns <- remoteConn:
+		return localConn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("netsim: dial %v: connection refused", address)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type conn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type listener struct {
+	host      *Host
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.host.network.mutex.Lock()
+		delete(l.host.listeners, l.addr.Port)
+		l.host.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+type packet struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+// PacketConn is a UDP socket of a Host.
+type PacketConn struct {
+	host      *Host
+	port      int
+	packets   chan packet
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mutex        sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.readDeadline
+	c.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	case <-timeout:
+		return 0, nil, ErrTimeout
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("netsim: invalid address type: %T", addr)
+	}
+	c.host.network.mutex.Lock()
+	c.host.network.send(c.host, c.port, dst, b)
+	c.host.network.mutex.Unlock()
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.host.network.mutex.Lock()
+		delete(c.host.conns, c.port)
+		c.host.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: c.host.ip, Port: c.port}
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func parseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		panic(fmt.Sprintf("netsim: invalid IP address: %q", s))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
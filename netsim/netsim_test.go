@@ -0,0 +1,12 @@
+package netsim_test
+
+import (
+	"net"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/netsim"
+)
+
+// ensure the transports are interchangeable
+var _ TCPTransport = (*netsim.Host)(nil)
+var _ net.PacketConn = (*netsim.PacketConn)(nil)
@@ -0,0 +1,189 @@
+// Package netsimtest runs servers, relays and clients on simulated networks,
+// for the end-to-end tests of the other packages.
+package netsimtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/relay"
+	"github.com/delthas/punch-check/server"
+)
+
+// Discard is a logger that discards its output.
+var Discard = log.New(ioutil.Discard, "", 0)
+
+// ServerAddress is the address of the server run by Serve by default.
+const ServerAddress = "1.0.0.1:17485"
+
+// Config configures the server and relays run by Serve. Its zero value runs a
+// default server at ServerAddress and two relays with two ports each.
+type Config struct {
+	// Server is the server to run, a default server if nil. Relays
+	// authenticate with its RelayKey if set, or else by their IP.
+	Server *server.Server
+	// ServerIP is the IP of the server host, 1.0.0.1 if empty.
+	ServerIP string
+	// RelayIPs are the IPs of the relay hosts, 2.0.0.1 and 3.0.0.1 if empty.
+	// Relays with an IPv6 IP run over IPv6.
+	RelayIPs []string
+	// RelayPorts are the ports of each relay, 1000 and 1001 if empty.
+	RelayPorts []int
+	// If ServerTLS is set, the server accepts connections over TLS, and relays
+	// connect with RelayTLS, authenticating with its certificate if it has
+	// one.
+	ServerTLS *tls.Config
+	RelayTLS  *tls.Config
+}
+
+// Serve runs a server and relays on n as configured by config, until ctx is
+// done, and returns the server.
+func Serve(t *testing.T, ctx context.Context, n *netsim.Network, config Config) *server.Server {
+	t.Helper()
+	s := config.Server
+	if s == nil {
+		s = &server.Server{
+			ErrorLog: Discard,
+		}
+	}
+	serverIP := config.ServerIP
+	if serverIP == "" {
+		serverIP = "1.0.0.1"
+	}
+	relayIPs := config.RelayIPs
+	if len(relayIPs) == 0 {
+		relayIPs = []string{"2.0.0.1", "3.0.0.1"}
+	}
+	relayPorts := config.RelayPorts
+	if len(relayPorts) == 0 {
+		relayPorts = []int{1000, 1001}
+	}
+
+	serverHost := n.AddHost(serverIP, nil)
+	network := "tcp4"
+	if serverHost.IP().To4() == nil {
+		network = "tcp6"
+	}
+	l, err := serverHost.Listen(network, ":17485")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerTLS != nil {
+		l = tls.NewListener(l, config.ServerTLS)
+	}
+	relayHosts := make([]*netsim.Host, len(relayIPs))
+	for i, ip := range relayIPs {
+		relayHosts[i] = n.AddHost(ip, nil)
+		if s.RelayKey == nil && (config.RelayTLS == nil || config.RelayTLS.Certificates == nil) {
+			s.Relays = append(s.Relays, relayHosts[i].IP())
+		}
+	}
+	go s.Serve(l)
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+
+	for _, h := range relayHosts {
+		r := &relay.Relay{
+			Server:       net.JoinHostPort(serverIP, "17485"),
+			Ports:        relayPorts,
+			RetryTimeout: 10 * time.Millisecond,
+			STUN:         true,
+			IPv6:         h.IP().To4() == nil,
+			Key:          s.RelayKey,
+			Transport:    h,
+			TLSConfig:    config.RelayTLS,
+			ErrorLog:     Discard,
+		}
+		go r.Run(ctx)
+	}
+	return s
+}
+
+// Check runs a test, waiting for the relays to be registered. The server
+// defaults to ServerAddress.
+func Check(ctx context.Context, options client.Options) (*MessageResult, error) {
+	if options.Server == "" {
+		options.Server = ServerAddress
+	}
+	for {
+		result, err := client.Check(ctx, options)
+		var serverErr *client.ServerError
+		if errors.As(err, &serverErr) && strings.Contains(serverErr.Message, "relays") && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result.Details == nil {
+			return nil, fmt.Errorf("no structured result: %s", result.Message)
+		}
+		return result.Details, nil
+	}
+}
+
+// Run runs a default server, two relays and a client behind a NAT with the
+// given configuration and public IPs, and returns the test result.
+func Run(t *testing.T, config netsim.NATConfig, publicIPs ...string) *MessageResult {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	Serve(t, ctx, n, Config{})
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(config, publicIPs...))
+
+	result, err := Check(ctx, client.Options{
+		Transport: clientHost,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// Metrics returns the metrics of s.
+func Metrics(s *server.Server) string {
+	w := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+// WaitMetrics waits until the metrics of s contain line.
+func WaitMetrics(t *testing.T, ctx context.Context, s *server.Server, line string) {
+	t.Helper()
+	for !strings.Contains(Metrics(s), line) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("metrics do not contain %q:\n%s", line, Metrics(s))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// ExpectBehaviors checks the mapping and filtering behaviors of r.
+func ExpectBehaviors(t *testing.T, r *MessageResult, mapping Behavior, filtering Behavior) {
+	t.Helper()
+	if r.UDPBlocked {
+		t.Fatalf("blocked UDP detected")
+	}
+	if r.Mapping != mapping {
+		t.Errorf("expected mapping %q, got %q", mapping, r.Mapping)
+	}
+	if r.Filtering != filtering {
+		t.Errorf("expected filtering %q, got %q", filtering, r.Filtering)
+	}
+}
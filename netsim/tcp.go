@@ -0,0 +1,146 @@
+package netsim
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// synInterval is the interval between retransmissions of dropped connection
+// attempts of DialFrom
+var synInterval = 100 * time.Millisecond
+
+// DialFrom opens a TCP connection from localPort. Unlike Dial, connections go
+// through the mapping and filtering of NATs, separately from UDP. Connection
+// attempts dropped by a NAT are retried until ctx is done, so that
+// connections opened from both ends at the same time succeed; connections to
+// a port without a listener are refused.
+func (h *Host) DialFrom(ctx context.Context, network string, localPort int, address string) (net.Conn, error) {
+	if err := h.checkNetwork(network, "tcp"); err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	dst := &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	for {
+		l, src := h.route(localPort, dst)
+		if l != nil {
+			return h.accept(ctx, l, localPort, addr, src)
+		}
+		if src != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: syscall.ECONNREFUSED}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(synInterval):
+		}
+	}
+}
+
+// route routes a connection attempt from a host port. It returns the
+// listener and the source address of the connection as seen from the
+// listener, only the source address if the destination refuses it, or nothing
+// if it is dropped.
+func (h *Host) route(port int, dst *net.UDPAddr) (*listener, *net.UDPAddr) {
+	n := h.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	src := &net.UDPAddr{IP: h.ip, Port: port}
+	if h.nat != nil {
+		nat := h.nat
+		src = nat.outbound("tcp", src, dst)
+		if src == nil {
+			return nil, nil
+		}
+		if nat.owns(dst.IP) && !nat.config.Hairpinning {
+			return nil, nil
+		}
+	}
+	if nat, ok := n.nats[dst.IP.String()]; ok {
+		dst = nat.inbound("tcp", src, dst)
+		if dst == nil {
+			return nil, nil
+		}
+	}
+	target, ok := n.hosts[dst.IP.String()]
+	if !ok {
+		return nil, nil
+	}
+	return target.listeners[dst.Port], src
+}
+
+// accept hands the connection from localPort to l.
+func (h *Host) accept(ctx context.Context, l *listener, localPort int, addr *net.TCPAddr, src *net.UDPAddr) (net.Conn, error) {
+	local, remote := net.Pipe()
+	localConn := newStreamConn(local, &net.TCPAddr{IP: h.ip, Port: localPort}, addr)
+	remoteConn := newStreamConn(remote, l.addr, &net.TCPAddr{IP: src.IP, Port: src.Port})
+	select {
+	case l.conns <- remoteConn:
+		return localConn, nil
+	case <-l.closed:
+		localConn.Close()
+		remoteConn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: addr, Err: syscall.ECONNREFUSED}
+	case <-ctx.Done():
+		localConn.Close()
+		remoteConn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// streamConn is a connection opened by DialFrom. Its writes are buffered, so
+// that they do not block until the peer reads, as with TCP.
+type streamConn struct {
+	conn
+	writes    chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamConn(c net.Conn, local net.Addr, remote net.Addr) *streamConn {
+	sc := &streamConn{
+		conn: conn{
+			Conn:   c,
+			local:  local,
+			remote: remote,
+		},
+		writes: make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case b := <-sc.writes:
+				if _, err := sc.Conn.Write(b); err != nil {
+					return
+				}
+			case <-sc.closed:
+				return
+			}
+		}
+	}()
+	return sc
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	select {
+	case c.writes <- buf:
+		return len(b), nil
+	case <-c.closed:
+		return 0, ErrClosed
+	}
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
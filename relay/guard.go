@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// guardRate is the maximum rate of packets and connections sent to a
+// destination IP, per second and per open test session of the IP, so that
+// concurrent tests of clients sharing an IP are not rate-limited
+var guardRate = 100.0
+
+// guardBurst is the maximum number of packets and connections sent to a
+// destination IP at once, per open test session of the IP
+var guardBurst = 100.0
+
+// guardSessionTimeout is the duration after which test sessions expire, longer
+// than the longest test
+var guardSessionTimeout = 2 * time.Hour
+
+// guardMaxSessions is the maximum number of test sessions open at once on a
+// control connection
+var guardMaxSessions = 1024
+
+// guardMaxSessionIPs is the maximum number of IPs of a test session
+var guardMaxSessionIPs = 8
+
+// stunRate is the maximum rate of STUN responses sent to a source IP, per
+// second
+var stunRate = 10.0
+
+// stunBurst is the maximum number of STUN responses sent to a source IP at
+// once
+var stunBurst = 20.0
+
+// stunPruneInterval is the interval at which the STUN rate limits of idle IPs
+// are removed
+var stunPruneInterval = time.Minute
+
+// Counters are the counts of packets and connections the server asked a relay
+// to send.
+type Counters struct {
+	Sent        uint64 // sent
+	Unknown     uint64 // refused because the destination IP has no open test session
+	RateLimited uint64 // refused because of the rate limit of the destination IP
+	STUNLimited uint64 // STUN responses refused because of the rate limit of the source IP
+}
+
+// guard restricts the packets and connections sent on behalf of the server to
+// the IPs of open test sessions, at a limited rate per IP, so that relays
+// cannot be used as reflectors even if the server is compromised.
+type guard struct {
+	mutex       sync.Mutex
+	sessions    map[uint64]*guardSession
+	buckets     map[string]*bucket // by destination IP
+	stunBuckets map[string]*bucket // by STUN source IP
+	stunPruned  time.Time
+	counters    Counters
+}
+
+type guardSession struct {
+	control *controlConn // control connection the session was opened on
+	since   time.Time
+	ips     []net.IP
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newGuard() *guard {
+	return &guard{
+		sessions:    make(map[uint64]*guardSession),
+		buckets:     make(map[string]*bucket),
+		stunBuckets: make(map[string]*bucket),
+	}
+}
+
+// take takes a token from b, refilled at rate up to burst, and returns
+// whether one was available.
+func (b *bucket) take(now time.Time, rate float64, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// open opens session for ip, and returns false if control has too many open
+// sessions, or the session too many IPs.
+func (g *guard) open(control *controlConn, session uint64, ip net.IP, now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.expire(now)
+	s, ok := g.sessions[session]
+	if !ok {
+		n := 0
+		for _, s := range g.sessions {
+			if s.control == control {
+				n++
+			}
+		}
+		if n >= guardMaxSessions {
+			return false
+		}
+		s = &guardSession{
+			control: control,
+			since:   now,
+		}
+		g.sessions[session] = s
+	}
+	for _, sip := range s.ips {
+		if sip.Equal(ip) {
+			return true
+		}
+	}
+	if len(s.ips) >= guardMaxSessionIPs {
+		return false
+	}
+	s.ips = append(s.ips, ip)
+	return true
+}
+
+// expire closes the sessions opened for longer than guardSessionTimeout. It
+// must be called with g.mutex held.
+func (g *guard) expire(now time.Time) {
+	expired := false
+	for session, s := range g.sessions {
+		if now.Sub(s.since) > guardSessionTimeout {
+			delete(g.sessions, session)
+			expired = true
+		}
+	}
+	if expired {
+		g.prune()
+	}
+}
+
+// close closes session.
+func (g *guard) close(session uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.sessions, session)
+	g.prune()
+}
+
+// closeAll closes the sessions opened on control, when it is closed.
+func (g *guard) closeAll(control *controlConn) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for session, s := range g.sessions {
+		if s.control == control {
+			delete(g.sessions, session)
+		}
+	}
+	g.prune()
+}
+
+// prune removes the buckets of IPs without open sessions. It must be called
+// with g.mutex held.
+func (g *guard) prune() {
+	for ip := range g.buckets {
+		if g.opened(net.ParseIP(ip)) == 0 {
+			delete(g.buckets, ip)
+		}
+	}
+}
+
+// opened returns the number of open sessions of ip. It must be called with
+// g.mutex held.
+func (g *guard) opened(ip net.IP) int {
+	n := 0
+	for _, s := range g.sessions {
+		for _, sip := range s.ips {
+			if sip.Equal(ip) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// allow returns whether a packet or connection can be sent to ip, and counts
+// it.
+func (g *guard) allow(ip net.IP, now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.expire(now)
+	sessions := g.opened(ip)
+	if sessions == 0 {
+		g.counters.Unknown++
+		return false
+	}
+	rate := guardRate * float64(sessions)
+	burst := guardBurst * float64(sessions)
+	b, ok := g.buckets[ip.String()]
+	if !ok {
+		b = &bucket{
+			tokens: burst,
+			last:   now,
+		}
+		g.buckets[ip.String()] = b
+	}
+	if !b.take(now, rate, burst) {
+		g.counters.RateLimited++
+		return false
+	}
+	g.counters.Sent++
+	return true
+}
+
+// allowSTUN returns whether a STUN response can be sent to ip, and counts it.
+// STUN clients have no test session, so STUN responses are only rate-limited
+// per source IP, to limit the use of relays as reflectors with spoofed
+// requests.
+func (g *guard) allowSTUN(ip net.IP, now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if now.Sub(g.stunPruned) >= stunPruneInterval {
+		for ip, b := range g.stunBuckets {
+			if now.Sub(b.last) >= stunPruneInterval {
+				delete(g.stunBuckets, ip)
+			}
+		}
+		g.stunPruned = now
+	}
+	b, ok := g.stunBuckets[ip.String()]
+	if !ok {
+		b = &bucket{
+			tokens: stunBurst,
+			last:   now,
+		}
+		g.stunBuckets[ip.String()] = b
+	}
+	if !b.take(now, stunRate, stunBurst) {
+		g.counters.STUNLimited++
+		return false
+	}
+	return true
+}
+
+func (g *guard) get() Counters {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.counters
+}
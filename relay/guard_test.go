@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	ip := net.IPv4(6, 0, 0, 1).To4()
+	now := time.Now()
+	sends := func(g *guard) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if g.allow(ip, now) {
+				n++
+			}
+		}
+		return n
+	}
+
+	g := newGuard()
+	if n := sends(g); n != 0 {
+		t.Errorf("without session: expected 0 sends, got %d", n)
+	}
+	g.open(nil, 1, ip, now)
+	if n := sends(g); n != int(guardBurst) {
+		t.Errorf("with one session: expected %v sends, got %d", guardBurst, n)
+	}
+
+	g = newGuard()
+	g.open(nil, 1, ip, now)
+	g.open(nil, 2, ip, now) // another client sharing the IP
+	if n := sends(g); n != 2*int(guardBurst) {
+		t.Errorf("with two sessions: expected %v sends, got %d", 2*guardBurst, n)
+	}
+	g.close(1)
+	g.close(2)
+	if n := sends(g); n != 0 {
+		t.Errorf("after closing the sessions: expected 0 sends, got %d", n)
+	}
+	if c := g.get(); c.Sent != 2*uint64(guardBurst) || c.Unknown != 1000 || c.RateLimited != 1000-2*uint64(guardBurst) {
+		t.Errorf("unexpected counters: %+v", c)
+	}
+}
+
+func TestGuardExpiry(t *testing.T) {
+	g := newGuard()
+	ip := net.IPv4(6, 0, 0, 1).To4()
+	now := time.Now()
+	g.open(nil, 1, ip, now)
+	g.open(nil, 1, ip, now) // opened again for the same IP
+	if s := g.sessions[1]; s == nil || len(s.ips) != 1 {
+		t.Fatalf("expected one session with one IP, got %+v", s)
+	}
+	if !g.allow(ip, now.Add(guardSessionTimeout)) {
+		t.Errorf("session expired before its timeout")
+	}
+	if g.allow(ip, now.Add(guardSessionTimeout+time.Second)) {
+		t.Errorf("session did not expire after its timeout")
+	}
+	if len(g.sessions) != 0 || len(g.buckets) != 0 {
+		t.Errorf("expired session was not removed: %d sessions, %d buckets", len(g.sessions), len(g.buckets))
+	}
+}
+
+func TestGuardLimits(t *testing.T) {
+	g := newGuard()
+	now := time.Now()
+	control := &controlConn{}
+	for i := 0; i < guardMaxSessions; i++ {
+		if !g.open(control, uint64(i), net.IPv4(6, 0, byte(i>>8), byte(i)).To4(), now) {
+			t.Fatalf("session %d refused", i)
+		}
+	}
+	if g.open(control, uint64(guardMaxSessions), net.IPv4(7, 0, 0, 1).To4(), now) {
+		t.Errorf("session opened past the maximum number of sessions")
+	}
+	if !g.open(nil, uint64(guardMaxSessions), net.IPv4(7, 0, 0, 1).To4(), now) {
+		t.Errorf("session of another control connection refused")
+	}
+
+	for i := 1; i < guardMaxSessionIPs; i++ {
+		if !g.open(control, 0, net.IPv4(8, 0, 0, byte(i)).To4(), now) {
+			t.Fatalf("IP %d refused", i)
+		}
+	}
+	if g.open(control, 0, net.IPv4(9, 0, 0, 1).To4(), now) {
+		t.Errorf("IP opened past the maximum number of IPs of a session")
+	}
+	if !g.open(control, 0, net.IPv4(8, 0, 0, 1).To4(), now) {
+		t.Errorf("IP of the session refused")
+	}
+
+	later := now.Add(guardSessionTimeout + time.Second)
+	if !g.open(control, uint64(guardMaxSessions), net.IPv4(7, 0, 0, 1).To4(), later) {
+		t.Errorf("session refused after the other sessions expired")
+	}
+}
+
+func TestGuardSTUN(t *testing.T) {
+	g := newGuard()
+	ip := net.IPv4(6, 0, 0, 1).To4()
+	other := net.IPv4(6, 0, 0, 2).To4()
+	now := time.Now()
+	n := 0
+	for i := 0; i < 100; i++ {
+		if g.allowSTUN(ip, now) {
+			n++
+		}
+	}
+	if n != int(stunBurst) {
+		t.Errorf("expected %v STUN responses, got %d", stunBurst, n)
+	}
+	if !g.allowSTUN(other, now) {
+		t.Errorf("STUN responses to another IP are rate-limited")
+	}
+	if !g.allowSTUN(ip, now.Add(time.Second)) {
+		t.Errorf("STUN responses are not allowed after the rate limit refills")
+	}
+	if c := g.get(); c.STUNLimited != 100-uint64(stunBurst) {
+		t.Errorf("unexpected counters: %+v", c)
+	}
+}
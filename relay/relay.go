@@ -1,174 +1,526 @@
-package main
+// Package relay implements punch-check relays, which send and receive UDP
+// packets on public ports on behalf of the server.
+package relay
 
 import (
-	"flag"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/stun"
 )
 
-var retryTimeout = 15 * time.Second
+var DefaultRetryTimeout = 15 * time.Second
 
-var logErr = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
-var logDebug *log.Logger
+// tcpHoldTimeout is the time TCP connections of the TCP test are kept open
+var tcpHoldTimeout = 30 * time.Second
 
-var mutex sync.Mutex
-var control *net.TCPConn
+// heartbeatTimeout is the time without messages from a server that sends
+// heartbeats, after which the connection is considered dead and reopened
+var heartbeatTimeout = 30 * time.Second
 
-var cs []*net.UDPConn
-var ports []int
+// refusedLogInterval is the interval at which the number of refused sends is
+// logged, if any
+var refusedLogInterval = time.Minute
 
-var closed uint32 = 0
+// relays always send MessageHello, so they require protocol version 1
+var minProtocolVersion = 1
 
-func writeControl(m Message) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	if control == nil {
+type Relay struct {
+	// Server is the server hostname[:port]. If no port is given, the server
+	// address is resolved with an SRV lookup.
+	Server string
+	// Ports are the public UDP ports to listen on.
+	Ports []int
+	// IPv6 additionally connects to the server over IPv6 to serve IPv6 tests.
+	IPv6 bool
+	// STUN answers the STUN binding requests received on the ports, so that
+	// STUN clients can use the relay as a STUN server. Requests to change the
+	// response port are answered from the first port, or the second port for
+	// requests received on the first port. Requests to change the response IP
+	// are rejected.
+	STUN bool
+	// Key, if set, is the pre-shared key to authenticate to the server with,
+	// for servers that do not identify relays by their IP or TLS certificate.
+	Key []byte
+	// RetryTimeout is the delay between connection attempts to the server.
+	// Defaults to DefaultRetryTimeout.
+	RetryTimeout time.Duration
+	// Transport, if set, creates the network connections. Defaults to
+	// NetTransport.
+	Transport Transport
+	// TLSConfig, if set, is used to connect to the server over TLS. Its server
+	// name defaults to the server hostname. It can hold a client certificate
+	// to authenticate to the server with.
+	TLSConfig *tls.Config
+	// ErrorLog, if set, receives error logs. Defaults to logging to stderr.
+	ErrorLog *log.Logger
+	// Debug, if set, receives debug logs.
+	Debug *log.Logger
+
+	cs       []net.PacketConn
+	ls       []net.Listener // TCP listeners on the ports, if the transport supports TCP
+	features []string
+	guard    *guard
+
+	// the server identifies relays by the IP of their control connection, so
+	// packets are forwarded on the control connection of their IP family
+	control4 controlConn
+	control6 controlConn
+}
+
+type controlConn struct {
+	mutex sync.Mutex
+	c     net.Conn
+}
+
+func (c *controlConn) write(m Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.c == nil {
 		return
 	}
-	WriteMessage(control, m)
+	WriteMessage(c.c, m)
 }
 
-func main() {
-	serverHost := flag.String("host", "", "server hostname[:port] (required)")
-	debug := flag.Bool("debug", false, "add debug logging")
-	var portsStr []string
-	flag.Var((*StringSliceFlag)(&portsStr), "port", "port to listen on (pass multiple times for multiple ports)")
-	flag.Parse()
+func (c *controlConn) set(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.c = conn
+}
 
-	if len(portsStr) < RelayPortsCount {
-		fmt.Fprintf(os.Stderr, "at least %d ports are required (use -port)\n", RelayPortsCount)
-		flag.Usage()
-		return
+// Run runs the relay until ctx is done or a fatal error occurs.
+func (r *Relay) Run(ctx context.Context) error {
+	if len(r.Ports) < RelayPortsCount {
+		return fmt.Errorf("at least %d ports are required", RelayPortsCount)
 	}
-	if *serverHost == "" {
-		fmt.Fprintf(os.Stderr, "-host is required\n")
-		flag.Usage()
-		return
+	if r.RetryTimeout == 0 {
+		r.RetryTimeout = DefaultRetryTimeout
 	}
-
-	if *debug {
-		logDebug = log.New(os.Stderr, "debug: ", log.Ldate|log.Ltime|log.Lshortfile)
-	} else {
-		logDebug = log.New(ioutil.Discard, "", 0)
+	if r.Transport == nil {
+		r.Transport = NetTransport
 	}
-
-	var serverAddr *net.TCPAddr
-	_, _, err := net.SplitHostPort(*serverHost)
-	if err != nil {
-		serverAddr, err = ResolveTCPBySRV("punchcheck", *serverHost)
-		if err != nil {
-			logErr.Fatalf("failed resolving server host %q: %v", *serverHost, err)
-		}
-	} else {
-		serverAddr, err = net.ResolveTCPAddr("tcp4", *serverHost)
-		if err != nil {
-			logErr.Fatalf("failed resolving server host %q: %v", *serverHost, err)
-		}
+	if r.ErrorLog == nil {
+		r.ErrorLog = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	}
+	if r.Debug == nil {
+		r.Debug = log.New(ioutil.Discard, "", 0)
 	}
 
-	defer atomic.StoreUint32(&closed, 1)
-
-	cs = make([]*net.UDPConn, len(portsStr))
-	ports = make([]int, len(cs))
-	for i, portStr := range portsStr {
-		port, err := strconv.Atoi(portStr)
+	network := "udp4"
+	if r.IPv6 {
+		network = "udp"
+	}
+	r.cs = make([]net.PacketConn, len(r.Ports))
+	for i, port := range r.Ports {
+		c, err := r.Transport.ListenPacket(network, net.JoinHostPort("", strconv.Itoa(port)))
 		if err != nil {
-			log.Fatalf("failed parsing UDP port %d: %v", port, err)
+			for _, c := range r.cs[:i] {
+				c.Close()
+			}
+			return fmt.Errorf("creating UDP socket for port %d: %v", port, err)
 		}
-		c, err := net.ListenUDP("udp4", &net.UDPAddr{
-			Port: port,
-		})
-		if err != nil {
-			log.Fatalf("failed creating UDP socket for port %d: %v", port, err)
+		r.cs[i] = c
+	}
+	r.guard = newGuard()
+	r.features = Features
+	if err := r.listenTCP(); err != nil {
+		r.ErrorLog.Printf("failed listening on TCP ports, disabling TCP tests: %v", err)
+		var features []string
+		for _, f := range Features {
+			if f != FeatureTCP {
+				features = append(features, f)
+			}
 		}
-		cs[i] = c
-		ports[i] = port
+		r.features = features
 	}
 
-	for i, c := range cs {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, len(r.cs))
+	var wg sync.WaitGroup
+	for i, c := range r.cs {
 		c := c
-		i := i
+		port := r.Ports[i]
+		alternate := 0
+		if i == 0 {
+			alternate = 1
+		}
+		stunServer := &stun.Server{
+			Conns: [2][2]net.PacketConn{{c, r.cs[alternate]}},
+			Allow: func(addr *net.UDPAddr) bool {
+				return r.guard.allowSTUN(addr.IP, time.Now())
+			},
+		}
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for {
 				buf := make([]byte, 1536)
-				n, addr, err := c.ReadFromUDP(buf)
+				n, a, err := c.ReadFrom(buf)
 				if err != nil {
-					if atomic.LoadUint32(&closed) == 1 {
-						return
+					if ctx.Err() == nil {
+						errCh <- fmt.Errorf("reading from UDP socket: %v", err)
+						cancel()
 					}
-					logErr.Fatalf("reading from UDP socket: %v", err)
+					return
 				}
 				buf = buf[:n]
+				addr, ok := a.(*net.UDPAddr)
+				if !ok {
+					continue
+				}
+				if r.STUN && stunServer.Handle(0, 0, buf, addr) {
+					r.Debug.Printf("handled STUN binding request from %s:%d on %d", addr.IP.String(), addr.Port, port)
+					continue
+				}
 
-				logDebug.Printf("forwarding read from %s:%d on %d: %v", addr.IP.String(), addr.Port, ports[i], buf)
-				writeControl(&MessageReceive{
-					LocalPort: ports[i],
+				r.Debug.Printf("forwarding read from %s:%d on %d: %v", addr.IP.String(), addr.Port, port, buf)
+				m := &MessageReceive{
+					LocalPort: port,
 					IP:        addr.IP,
 					Port:      addr.Port,
 					Data:      buf,
-				})
+				}
+				if addr.IP.To4() != nil {
+					r.control4.write(m)
+				} else {
+					r.control6.write(m)
+				}
 			}
 		}()
 	}
 
+	for i, l := range r.ls {
+		l := l
+		port := r.Ports[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					if ctx.Err() == nil {
+						errCh <- fmt.Errorf("accepting TCP connection: %v", err)
+						cancel()
+					}
+					return
+				}
+				go r.acceptTCP(c, port)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.logRefused(ctx)
+	}()
+
+	if r.IPv6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.connect(ctx, "tcp6", &r.control6)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.connect(ctx, "tcp4", &r.control4)
+	}()
+
+	<-ctx.Done()
+	for _, c := range r.cs {
+		c.Close()
+	}
+	for _, l := range r.ls {
+		l.Close()
+	}
+	wg.Wait()
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+func (r *Relay) connect(ctx context.Context, network string, control *controlConn) {
 	first := true
 	for {
 		if !first {
-			time.Sleep(15 * time.Second)
+			select {
+			case <-time.After(r.RetryTimeout):
+			case <-ctx.Done():
+				return
+			}
 		} else {
 			first = false
 		}
-		c, err := net.DialTCP("tcp4", nil, serverAddr)
+
+		var serverAddr *net.TCPAddr
+		_, _, err := net.SplitHostPort(r.Server)
 		if err != nil {
-			logErr.Printf("failed dialing server at %q, retrying in %v: %v", *serverHost, retryTimeout, err)
+			serverAddr, err = ResolveTCPBySRV(network, "punchcheck", r.Server)
+		} else {
+			serverAddr, err = net.ResolveTCPAddr(network, r.Server)
+		}
+		if err != nil {
+			r.ErrorLog.Printf("failed resolving server host %q over %s, retrying in %v: %v", r.Server, network, r.RetryTimeout, err)
 			continue
 		}
-		c.SetNoDelay(true)
-		logErr.Printf("connected to server: %q", *serverHost)
-		WriteMessage(c, &MessagePorts{
-			Ports: ports,
+
+		c, err := r.Transport.Dial(ctx, network, serverAddr.String())
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.ErrorLog.Printf("failed dialing server at %q over %s, retrying in %v: %v", r.Server, network, r.RetryTimeout, err)
+			continue
+		}
+		if c, ok := c.(*net.TCPConn); ok {
+			c.SetNoDelay(true)
+		}
+		if r.TLSConfig != nil {
+			c = TLSClient(c, r.TLSConfig, r.Server)
+		}
+		r.ErrorLog.Printf("connected to server over %s: %q", network, r.Server)
+		control.set(c)
+		control.write(&MessageHello{
+			Version:    ProtocolVersion,
+			MinVersion: minProtocolVersion,
+			Features:   r.features,
 		})
-		mutex.Lock()
-		control = c
-		mutex.Unlock()
-
-	outer:
-		for {
-			m, err := ReadMessage(control)
-			if err != nil {
-				logErr.Printf("reading message from control socket: %v", err)
-				break
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-done:
+			}
+		}()
+		r.serve(ctx, c, control)
+		close(done)
+		r.guard.closeAll(control)
+
+		control.set(nil)
+		c.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		r.ErrorLog.Printf("disconnected from server over %s, retrying in %v", network, r.RetryTimeout)
+	}
+}
+
+func (r *Relay) serve(ctx context.Context, c net.Conn, control *controlConn) {
+	heartbeat := false
+	for {
+		if heartbeat {
+			c.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+		}
+		m, err := ReadMessage(c)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && heartbeat {
+				r.ErrorLog.Printf("no heartbeat from server for %v", heartbeatTimeout)
+			} else if ctx.Err() == nil {
+				r.ErrorLog.Printf("reading message from control socket: %v", err)
+			}
+			return
+		}
+		switch m := m.(type) {
+		case *MessageHello:
+			if _, err := m.Negotiate(ProtocolVersion, minProtocolVersion); err != nil {
+				r.ErrorLog.Printf("invalid handshake: %v", err)
+				return
 			}
-			switch m := m.(type) {
-			case *MessageSend:
-				index := Index(ports, m.LocalPort)
-				if index == -1 {
-					logErr.Fatalf("invalid send message: invalid local port: %d", m.LocalPort)
+			if !m.Supports(FeatureSessions) {
+				r.ErrorLog.Printf("invalid handshake: server does not open test sessions")
+				return
+			}
+			if r.Key != nil {
+				if len(m.Challenge) == 0 {
+					r.ErrorLog.Printf("invalid handshake: server does not support relay authentication")
+					return
 				}
-				logDebug.Printf("writing to %s:%d from %d: %v", net.IP(m.IP).String(), m.Port, m.LocalPort, m.Data)
-				cs[index].WriteToUDP(m.Data, &net.UDPAddr{
-					IP:   m.IP,
-					Port: m.Port,
+				control.write(&MessageAuth{
+					MAC: RelayMAC(r.Key, m.Challenge),
 				})
-			default:
-				logErr.Printf("invalid message type: %v", MessageType(m.Type()))
-				break outer
 			}
+			control.write(&MessagePorts{
+				Ports: r.Ports,
+			})
+			heartbeat = m.Supports(FeatureHeartbeat)
+		case *MessagePing:
+			control.write(&MessagePing{
+				ID: m.ID,
+			})
+		case *MessageInfo:
+			r.ErrorLog.Printf("received error from server: %s", m.Message)
+			return
+		case *MessageSend:
+			index := Index(r.Ports, m.LocalPort)
+			if index == -1 {
+				r.ErrorLog.Printf("invalid send message: invalid local port: %d", m.LocalPort)
+				return
+			}
+			if !r.guard.allow(m.IP, time.Now()) {
+				r.Debug.Printf("refusing write to %s:%d from %d", net.IP(m.IP).String(), m.Port, m.LocalPort)
+				break
+			}
+			r.Debug.Printf("writing to %s:%d from %d: %v", net.IP(m.IP).String(), m.Port, m.LocalPort, m.Data)
+			r.cs[index].WriteTo(m.Data, &net.UDPAddr{
+				IP:   m.IP,
+				Port: m.Port,
+			})
+		case *MessageConnect:
+			if Index(r.Ports, m.LocalPort) == -1 || r.ls == nil {
+				r.ErrorLog.Printf("invalid connect message: invalid local port: %d", m.LocalPort)
+				return
+			}
+			if !r.guard.allow(m.IP, time.Now()) {
+				r.Debug.Printf("refusing connection to %s:%d from %d", net.IP(m.IP).String(), m.Port, m.LocalPort)
+				reply := *m
+				reply.Result = ConnectFailed
+				control.write(&reply)
+				break
+			}
+			go r.dialTCP(ctx, control, m)
+		case *MessageSession:
+			if m.Closed {
+				r.guard.close(m.Session)
+			} else if len(m.IP) > 0 && !r.guard.open(control, m.Session, m.IP, time.Now()) {
+				r.ErrorLog.Printf("refusing to open test session for %s: too many open sessions or session IPs", net.IP(m.IP).String())
+			}
+		default:
+			r.ErrorLog.Printf("invalid message type: %v", MessageType(m.Type()))
+			return
+		}
+	}
+}
+
+// Counters returns the counts of packets and connections the server asked the
+// relay to send.
+func (r *Relay) Counters() Counters {
+	if r.guard == nil {
+		return Counters{}
+	}
+	return r.guard.get()
+}
+
+// logRefused periodically logs the number of sends refused by the guard.
+func (r *Relay) logRefused(ctx context.Context) {
+	ticker := time.NewTicker(refusedLogInterval)
+	defer ticker.Stop()
+	var last Counters
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		counters := r.guard.get()
+		unknown := counters.Unknown - last.Unknown
+		rateLimited := counters.RateLimited - last.RateLimited
+		stunLimited := counters.STUNLimited - last.STUNLimited
+		if unknown > 0 || rateLimited > 0 || stunLimited > 0 {
+			r.ErrorLog.Printf("refused %d sends to IPs without test session, %d rate-limited sends and %d rate-limited STUN responses in the last %v", unknown, rateLimited, stunLimited, refusedLogInterval)
+		}
+		last = counters
+	}
+}
+
+// listenTCP listens on the TCP ports of the relay, if its transport supports
+// TCP tests.
+func (r *Relay) listenTCP() error {
+	transport, ok := r.Transport.(TCPTransport)
+	if !ok {
+		return fmt.Errorf("transport does not support TCP")
+	}
+	network := "tcp4"
+	if r.IPv6 {
+		network = "tcp"
+	}
+	ls := make([]net.Listener, len(r.Ports))
+	for i, port := range r.Ports {
+		l, err := transport.Listen(network, net.JoinHostPort("", strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range ls[:i] {
+				l.Close()
+			}
+			return fmt.Errorf("listening on TCP port %d: %v", port, err)
 		}
+		ls[i] = l
+	}
+	r.ls = ls
+	return nil
+}
 
-		logErr.Printf("disconnected from server, retrying in %v", retryTimeout)
-		mutex.Lock()
+// acceptTCP forwards the first data of a TCP connection accepted on port to
+// the server, and keeps it open for a while.
+func (r *Relay) acceptTCP(c net.Conn, port int) {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(TCPConnectTimeout))
+	buf := make([]byte, 2+8) // probe size
+	if _, err := io.ReadFull(c, buf); err != nil {
+		r.Debug.Printf("failed reading from TCP connection from %s:%d on %d: %v", addr.IP.String(), addr.Port, port, err)
 		c.Close()
-		control = nil
-		mutex.Unlock()
+		return
+	}
+	time.AfterFunc(tcpHoldTimeout, func() {
+		c.Close()
+	})
+	r.Debug.Printf("forwarding TCP connection from %s:%d on %d: %v", addr.IP.String(), addr.Port, port, buf)
+	m := &MessageAccept{
+		LocalPort: port,
+		IP:        addr.IP,
+		Port:      addr.Port,
+		Data:      buf,
+	}
+	if addr.IP.To4() != nil {
+		r.control4.write(m)
+	} else {
+		r.control6.write(m)
+	}
+}
+
+// dialTCP opens a TCP connection requested by the server, and replies with its
+// result.
+func (r *Relay) dialTCP(ctx context.Context, control *controlConn, m *MessageConnect) {
+	network := "tcp4"
+	if net.IP(m.IP).To4() == nil {
+		network = "tcp6"
+	}
+	address := net.JoinHostPort(net.IP(m.IP).String(), strconv.Itoa(m.Port))
+	r.Debug.Printf("connecting to %s from %d", address, m.LocalPort)
+	dialCtx, cancel := context.WithTimeout(ctx, TCPConnectTimeout)
+	c, err := r.Transport.(TCPTransport).DialFrom(dialCtx, network, m.LocalPort, address)
+	cancel()
+	if err == nil {
+		c.Write(m.Data)
+		time.AfterFunc(tcpHoldTimeout, func() {
+			c.Close()
+		})
+	} else {
+		r.Debug.Printf("failed connecting to %s from %d: %v", address, m.LocalPort, err)
 	}
+	reply := *m
+	reply.Result = DialResult(err)
+	control.write(&reply)
 }
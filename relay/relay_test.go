@@ -0,0 +1,220 @@
+package relay_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/relay"
+	"github.com/delthas/punch-check/server"
+)
+
+func TestRelayAuth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{
+		Server: &server.Server{
+			RelayKey: []byte("secret"),
+			ErrorLog: netsimtest.Discard,
+		},
+	})
+	impostor := &relay.Relay{
+		Server:       netsimtest.ServerAddress,
+		Ports:        []int{1000, 1001},
+		RetryTimeout: 10 * time.Millisecond,
+		Key:          []byte("guess"),
+		Transport:    n.AddHost("4.0.0.1", nil),
+		ErrorLog:     netsimtest.Discard,
+	}
+	go impostor.Run(ctx)
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+
+	for i := 0; i < 3; i++ {
+		result, err := netsimtest.Check(ctx, client.Options{
+			Transport: clientHost,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		netsimtest.ExpectBehaviors(t, result, EndpointIndependent, EndpointIndependent)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "punch-check CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	certificate := func(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "punch-check"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(1, 0, 0, 1)},
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}
+	}
+
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{
+		ServerTLS: &tls.Config{
+			Certificates: []tls.Certificate{certificate(2, x509.ExtKeyUsageServerAuth)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		RelayTLS: &tls.Config{
+			Certificates: []tls.Certificate{certificate(3, x509.ExtKeyUsageClientAuth)},
+			RootCAs:      pool,
+		},
+	})
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+
+	result, err := netsimtest.Check(ctx, client.Options{
+		Transport: clientHost,
+		TLSConfig: &tls.Config{
+			RootCAs: pool,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	netsimtest.ExpectBehaviors(t, result, EndpointIndependent, EndpointIndependent)
+}
+
+// TestRelayGuard checks that relays only send to the IPs of open test
+// sessions, even when the server asks otherwise.
+func TestRelayGuard(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	l, err := n.AddHost("1.0.0.1", nil).Listen("tcp4", ":17485")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := &relay.Relay{
+		Server:       netsimtest.ServerAddress,
+		Ports:        []int{1000, 1001},
+		RetryTimeout: 10 * time.Millisecond,
+		Transport:    n.AddHost("2.0.0.1", nil),
+		ErrorLog:     netsimtest.Discard,
+	}
+	go r.Run(ctx)
+	victim, err := n.AddHost("6.0.0.1", nil).ListenPacket("udp4", ":1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer victim.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := ReadMessage(c); err != nil { // relay hello
+		t.Fatal(err)
+	}
+	if err := WriteMessage(c, &MessageHello{
+		Version:  ProtocolVersion,
+		Features: Features,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := ReadMessage(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(*MessagePorts); ok {
+			break
+		}
+	}
+	send := &MessageSend{
+		LocalPort: 1000,
+		IP:        net.IPv4(6, 0, 0, 1).To4(),
+		Port:      1234,
+		Data:      []byte("probe"),
+	}
+	buf := make([]byte, 1536)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			if err := WriteMessage(c, &MessageSession{
+				Session: 1,
+				IP:      send.IP,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := WriteMessage(c, send); err != nil {
+			t.Fatal(err)
+		}
+		victim.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := victim.ReadFrom(buf)
+		if i == 0 && err == nil {
+			t.Errorf("relay sent to an IP without test session")
+		} else if i == 1 && err != nil {
+			t.Errorf("relay did not send to an IP with an open test session: %v", err)
+		}
+	}
+	if counters := r.Counters(); counters.Sent != 1 || counters.Unknown != 1 {
+		t.Errorf("unexpected relay counters: %+v", counters)
+	}
+}
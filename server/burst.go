@@ -0,0 +1,38 @@
+package server
+
+import (
+	"time"
+)
+
+var burstPortsCount = 20
+
+// burstTest observes the NAT ports of mappings of the burst ports to A0,
+// created in sequence, to analyze port assignment.
+type burstTest struct {
+	observationTest
+}
+
+func (t *burstTest) step(c *connection, now time.Time) bool {
+	complete := true
+	for _, port := range c.client.BurstNATPorts {
+		if port == 0 {
+			complete = false
+		}
+	}
+	if complete {
+		return true
+	}
+	a := c.client.relays[0]
+	for _, port := range c.client.BurstPorts { // burst -> A0
+		c.Write(c.client.session, port, a.addr.IP, a.ports[0])
+	}
+	return false
+}
+
+func (t *burstTest) receive(c *connection, p probe, now time.Time) {
+	i := p.clientPort - len(c.ports)
+	if p.inbound || p.relay != 0 || p.relayPort != 0 || i < 0 {
+		return
+	}
+	c.client.BurstNATPorts[i] = p.port
+}
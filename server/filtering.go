@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+)
+
+// filteringTest observes which relay ports, such as A0, A1 and B0, can send
+// to the mapping of C1 to A0.
+type filteringTest struct {
+	observationTest
+}
+
+func (t *filteringTest) complete(c *connection) bool {
+	for _, received := range c.client.ReceivedRelays {
+		for _, r := range received {
+			if !r {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *filteringTest) step(c *connection, now time.Time) bool {
+	if t.complete(c) {
+		return true
+	}
+	natPort := c.client.NATPorts[1]
+	natIP := c.client.NATIPs[1]
+	if natPort == 0 {
+		return false
+	}
+	for i, received := range c.client.ReceivedRelays {
+		relay := c.client.relays[i]
+		for j := range received {
+			relay.Write(c.client.session, relay.ports[j], natIP, natPort) // A0, A1, B0, ... -> C1
+		}
+	}
+	return false
+}
+
+func (t *filteringTest) receive(c *connection, p probe, now time.Time) {
+	if !p.inbound || p.relay == -1 || p.clientPort != 1 || p.relayPort >= len(c.client.ReceivedRelays[p.relay]) {
+		return
+	}
+	c.client.ReceivedRelays[p.relay][p.relayPort] = true
+	if p.relay == 0 && p.relayPort == 0 { // A0 -> C1
+		c.client.Received = true
+	} else if p.relay == 0 && p.relayPort == 1 { // A1 -> C1
+		c.client.ReceivedPortDependent = true
+	} else if p.relay == 1 && p.relayPort == 0 { // B0 -> C1
+		c.client.ReceivedEndpointDependent = true
+	}
+}
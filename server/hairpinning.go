@@ -0,0 +1,28 @@
+package server
+
+import (
+	"time"
+)
+
+// hairpinningTest observes whether C1 and C2 can send to each other through
+// the public addresses of their mappings.
+type hairpinningTest struct {
+	observationTest
+}
+
+func (t *hairpinningTest) step(c *connection, now time.Time) bool {
+	if c.client.ReceivedHairpinning {
+		return true
+	}
+	if c.client.NATPorts[1] != 0 && c.client.NATPorts[2] != 0 {
+		c.Write(c.client.session, c.ports[1], c.client.NATIPs[2], c.client.NATPorts[2]) // C1 -> C2
+		c.Write(c.client.session, c.ports[2], c.client.NATIPs[1], c.client.NATPorts[1]) // C2 -> C1
+	}
+	return false
+}
+
+func (t *hairpinningTest) receive(c *connection, p probe, now time.Time) {
+	if p.relay == -1 && p.clientPort == 1 && p.port == c.client.NATPorts[2] {
+		c.client.ReceivedHairpinning = true
+	}
+}
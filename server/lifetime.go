@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+// default bounds and resolution of the mapping lifetime search
+var lifetimeMin = 10 * time.Second
+var lifetimeMax = 10 * time.Minute
+var lifetimeResolution = 10 * time.Second
+
+var lifetimeRefreshTimeout = 5 * time.Second
+var lifetimeProbeTimeout = 2 * time.Second
+
+// lifetimePort is the index of the client port used for the lifetime test
+var lifetimePort = 3
+
+type lifetimeState int
+
+const (
+	lifetimeRefreshing lifetimeState = iota // sending C3 -> A0 until A0 receives it
+	lifetimeWaiting                         // waiting for the mapping to be idle for the tested interval
+	lifetimeProbing                         // sending A0 -> C3 until C3 receives it
+)
+
+// lifetimeTest measures the mapping lifetime with a binary search on the idle
+// interval after which the mapping of C3 -> A0 expires.
+type lifetimeTest struct {
+	min        time.Duration // bounds of the search
+	max        time.Duration
+	resolution time.Duration
+
+	state    lifetimeState
+	since    time.Time // start of the current state
+	interval time.Duration
+	natIP    net.IP
+	natPort  int
+	received bool
+	lifetime Lifetime
+}
+
+func (l *lifetimeTest) start(c *connection, result *MessageResult, now time.Time) bool {
+	l.state = lifetimeRefreshing
+	l.since = now
+	l.interval = l.min
+	c.send(&MessageInfo{
+		MessageType: 2,
+		Message:     "Measuring mapping lifetime, this can take up to an hour.",
+	})
+	return true
+}
+
+// step advances the test, and returns whether it is complete.
+func (l *lifetimeTest) step(c *connection, now time.Time) bool {
+	relay := c.client.relays[0]
+	switch l.state {
+	case lifetimeRefreshing:
+		if now.Sub(l.since) > lifetimeRefreshTimeout {
+			return true
+		}
+		c.Write(c.client.session, c.ports[lifetimePort], relay.addr.IP, relay.ports[0])
+	case lifetimeWaiting:
+		if now.Sub(l.since) >= l.interval {
+			l.state = lifetimeProbing
+			l.since = now
+			l.received = false
+		}
+	case lifetimeProbing:
+		if l.received {
+			l.lifetime.Min = l.interval
+		} else if now.Sub(l.since) > lifetimeProbeTimeout {
+			l.lifetime.Max = l.interval
+		} else {
+			relay.Write(c.client.session, relay.ports[0], l.natIP, l.natPort)
+			break
+		}
+		max := l.lifetime.Max
+		if max == 0 {
+			max = l.max
+		}
+		if max-l.lifetime.Min <= l.resolution {
+			return true
+		}
+		l.interval = (l.lifetime.Min + max) / 2
+		l.state = lifetimeRefreshing
+		l.since = now
+		l.natPort = 0
+		c.send(&MessageInfo{
+			MessageType: 2,
+			Message:     fmt.Sprintf("Measuring mapping lifetime: %s so far, now testing %v.", l.lifetime.String(), l.interval),
+		})
+	}
+	return false
+}
+
+func (l *lifetimeTest) receive(c *connection, p probe, now time.Time) {
+	if p.relay != 0 || p.relayPort != 0 || p.clientPort != lifetimePort {
+		return
+	}
+	if !p.inbound { // C3 -> A0
+		if l.state != lifetimeRefreshing {
+			return
+		}
+		l.natIP = p.ip
+		l.natPort = p.port
+		l.state = lifetimeWaiting
+		l.since = now
+	} else { // A0 -> C3
+		if l.state != lifetimeProbing {
+			return
+		}
+		l.received = true
+	}
+}
+
+func (l *lifetimeTest) finish(result *MessageResult) {
+	if l.lifetime.Min == 0 && l.lifetime.Max == 0 {
+		return
+	}
+	lifetime := l.lifetime
+	result.MappingLifetime = &lifetime
+}
@@ -0,0 +1,52 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/server"
+)
+
+// TestMappingLifetime checks that the measured mapping lifetime matches the
+// mapping timeout of the NAT, within the resolution of the search.
+func TestMappingLifetime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	s := &server.Server{
+		LifetimeMin:        time.Second,
+		LifetimeMax:        8 * time.Second,
+		LifetimeResolution: time.Second,
+		ErrorLog:           netsimtest.Discard,
+	}
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{Server: s})
+	timeout := 3 * time.Second
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{
+		Timeout: timeout,
+	}, "5.0.0.1"))
+
+	result, err := netsimtest.Check(ctx, client.Options{
+		Transport: clientHost,
+		Lifetime:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := result.MappingLifetime
+	if l == nil {
+		t.Fatal("expected a mapping lifetime")
+	}
+	if l.Min == 0 || l.Max == 0 || l.Max-l.Min > s.LifetimeResolution {
+		t.Errorf("expected a mapping lifetime within %v, got %v", s.LifetimeResolution, l)
+	}
+	if l.Min < timeout-s.LifetimeResolution || l.Max > timeout+s.LifetimeResolution {
+		t.Errorf("expected a mapping lifetime around %v, got %v", timeout, l)
+	}
+}
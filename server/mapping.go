@@ -0,0 +1,71 @@
+package server
+
+import (
+	"time"
+)
+
+// mappingTest observes the NAT ports of mappings of all client ports to A0,
+// and of C0 to all other relay ports, such as A1 and B0.
+type mappingTest struct {
+	observationTest
+}
+
+func (t *mappingTest) complete(c *connection) bool {
+	for _, port := range c.client.NATPorts {
+		if port == 0 {
+			return false
+		}
+	}
+	for i, ports := range c.client.RelayNATPorts {
+		for j, port := range ports {
+			if port == 0 && (i != 0 || j != 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *mappingTest) step(c *connection, now time.Time) bool {
+	if t.complete(c) {
+		return true
+	}
+	a := c.client.relays[0]
+	for i := len(c.ports) - 1; i >= 0; i-- { // C* -> A0
+		// send in reverse order to check both assignment contiguity and preservation
+		c.Write(c.client.session, c.ports[i], a.addr.IP, a.ports[0])
+	}
+	for i, ports := range c.client.RelayNATPorts {
+		relay := c.client.relays[i]
+		for j := range ports {
+			if i == 0 && j == 0 {
+				continue
+			}
+			c.Write(c.client.session, c.ports[0], relay.addr.IP, relay.ports[j]) // C0 -> A1, B0, ...
+		}
+	}
+	return false
+}
+
+func (t *mappingTest) receive(c *connection, p probe, now time.Time) {
+	if p.inbound || p.relay == -1 || p.clientPort >= len(c.ports) || p.relayPort >= len(c.client.RelayNATPorts[p.relay]) {
+		return
+	}
+	if p.relay == 0 && p.relayPort == 0 { // C* -> A0
+		c.client.NATPorts[p.clientPort] = p.port
+		c.client.NATIPs[p.clientPort] = p.ip
+		return
+	}
+	if p.clientPort != 0 {
+		return
+	}
+	c.client.RelayNATPorts[p.relay][p.relayPort] = p.port
+	c.client.RelayNATIPs[p.relay][p.relayPort] = p.ip
+	if p.relay == 0 && p.relayPort == 1 { // C0 -> A1
+		c.client.PortDependentNATPort = p.port
+		c.client.PortDependentNATIP = p.ip
+	} else if p.relay == 1 && p.relayPort == 0 { // C0 -> B0
+		c.client.EndpointDependentNATPort = p.port
+		c.client.EndpointDependentNATIP = p.ip
+	}
+}
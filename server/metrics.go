@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// testDurationBuckets are the upper bounds of the buckets of the test duration
+// histogram, in seconds
+var testDurationBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120}
+
+// metrics are the counters and gauges of a server, updated by its event loop
+// and read by its metrics handler.
+type metrics struct {
+	mutex sync.Mutex
+
+	testsStarted     uint64
+	testsCompleted   uint64
+	testsFailed      uint64 // closed before the main tests completed
+	testsInterrupted uint64 // closed after the main tests, before the result was sent
+	testsTimedOut    uint64 // main tests timed out
+	clientsRejected  uint64 // not enough relays available
+	verdicts         map[verdict]uint64
+	durations        map[string]*histogram // by kind of test plan
+	protocolErrors   map[string]uint64     // by kind
+
+	relays        int
+	relaysHealthy int
+	clients       int
+}
+
+type verdict struct {
+	name  string
+	value string
+}
+
+// kinds of test plans, labelling the test duration histogram
+var planKinds = []string{"rendezvous", "test"}
+
+type histogram struct {
+	counts []uint64 // by bucket of testDurationBuckets, then +Inf
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		verdicts:       make(map[verdict]uint64),
+		durations:      make(map[string]*histogram),
+		protocolErrors: make(map[string]uint64),
+	}
+	for _, kind := range planKinds {
+		m.durations[kind] = &histogram{
+			counts: make([]uint64, len(testDurationBuckets)+1),
+		}
+	}
+	return m
+}
+
+func (m *metrics) started() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.testsStarted++
+}
+
+func (m *metrics) rejected() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clientsRejected++
+}
+
+func (m *metrics) failed() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.testsFailed++
+}
+
+// completed counts a test that sent its result after duration.
+func (m *metrics) completed(p *testPlan, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.testsCompleted++
+	m.finished(p, duration)
+}
+
+// interrupted counts a test whose client disconnected after duration, during
+// the optional tests.
+func (m *metrics) interrupted(p *testPlan, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.testsInterrupted++
+	m.finished(p, duration)
+}
+
+// finished counts the duration and verdicts of a test whose main tests
+// completed. It must be called with m.mutex held.
+func (m *metrics) finished(p *testPlan, duration time.Duration) {
+	if p.timedOut {
+		m.testsTimedOut++
+	}
+	kind := "test"
+	if p.rendezvous {
+		kind = "rendezvous"
+	}
+	h := m.durations[kind]
+	seconds := duration.Seconds()
+	h.sum += seconds
+	h.counts[sort.SearchFloat64s(testDurationBuckets, seconds)]++
+	if p.rendezvous {
+		return
+	}
+	r := p.result
+	m.verdicts[verdict{"udp_blocked", strconv.FormatBool(r.UDPBlocked)}]++
+	if r.UDPBlocked {
+		return
+	}
+	m.verdicts[verdict{"mapping", string(r.Mapping)}]++
+	m.verdicts[verdict{"filtering", string(r.Filtering)}]++
+	m.verdicts[verdict{"hairpinning", strconv.FormatBool(r.Hairpinning)}]++
+	if r.Pooling != "" {
+		m.verdicts[verdict{"pooling", string(r.Pooling)}]++
+	}
+}
+
+// connections updates the gauges of the connected relays and clients.
+func (m *metrics) connections(relays int, relaysHealthy int, clients int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.relays = relays
+	m.relaysHealthy = relaysHealthy
+	m.clients = clients
+}
+
+// protocolError logs an invalid or unexpected message from a peer, and counts
+// it by kind.
+func (s *Server) protocolError(kind string, format string, v ...interface{}) {
+	s.logErr.Output(2, fmt.Sprintf(format, v...))
+	s.metrics.mutex.Lock()
+	defer s.metrics.mutex.Unlock()
+	s.metrics.protocolErrors[kind]++
+}
+
+// updateConnections updates the gauges of the connected relays and clients.
+func (s *Server) updateConnections(now time.Time) {
+	var relays, relaysHealthy, clients int
+	for _, c := range s.connections {
+		if c.relay {
+			relays++
+			if c.healthy(now) {
+				relaysHealthy++
+			}
+		} else if c.client != nil {
+			clients++
+		}
+	}
+	s.metrics.connections(relays, relaysHealthy, clients)
+}
+
+// MetricsHandler returns a handler that serves the metrics of the server in
+// the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	s.init()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		s.metrics.write(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	})
+}
+
+func (m *metrics) write(b *bytes.Buffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	header := func(name string, kind string, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("punch_check_tests_started_total", "counter", "Tests started.")
+	fmt.Fprintf(b, "punch_check_tests_started_total %d\n", m.testsStarted)
+	header("punch_check_tests_completed_total", "counter", "Tests that sent their result.")
+	fmt.Fprintf(b, "punch_check_tests_completed_total %d\n", m.testsCompleted)
+	header("punch_check_tests_failed_total", "counter", "Tests closed before their main tests completed.")
+	fmt.Fprintf(b, "punch_check_tests_failed_total %d\n", m.testsFailed)
+	header("punch_check_tests_interrupted_total", "counter", "Tests closed during their optional tests, before sending their result.")
+	fmt.Fprintf(b, "punch_check_tests_interrupted_total %d\n", m.testsInterrupted)
+	header("punch_check_tests_timed_out_total", "counter", "Tests whose main probes timed out before all were received.")
+	fmt.Fprintf(b, "punch_check_tests_timed_out_total %d\n", m.testsTimedOut)
+	header("punch_check_clients_rejected_total", "counter", "Clients rejected because not enough relays were available.")
+	fmt.Fprintf(b, "punch_check_clients_rejected_total %d\n", m.clientsRejected)
+
+	header("punch_check_verdicts_total", "counter", "Verdicts of tests whose main tests completed.")
+	verdicts := make([]verdict, 0, len(m.verdicts))
+	for v := range m.verdicts {
+		verdicts = append(verdicts, v)
+	}
+	sort.Slice(verdicts, func(i, j int) bool {
+		if verdicts[i].name != verdicts[j].name {
+			return verdicts[i].name < verdicts[j].name
+		}
+		return verdicts[i].value < verdicts[j].value
+	})
+	for _, v := range verdicts {
+		fmt.Fprintf(b, "punch_check_verdicts_total{verdict=%s,value=%s} %d\n", label(v.name), label(v.value), m.verdicts[v])
+	}
+
+	header("punch_check_test_duration_seconds", "histogram", "Duration of tests whose main tests completed, by kind.")
+	for _, kind := range planKinds {
+		h := m.durations[kind]
+		var count uint64
+		for i, bound := range testDurationBuckets {
+			count += h.counts[i]
+			fmt.Fprintf(b, "punch_check_test_duration_seconds_bucket{kind=%s,le=%s} %d\n", label(kind), label(strconv.FormatFloat(bound, 'g', -1, 64)), count)
+		}
+		count += h.counts[len(testDurationBuckets)]
+		fmt.Fprintf(b, "punch_check_test_duration_seconds_bucket{kind=%s,le=\"+Inf\"} %d\n", label(kind), count)
+		fmt.Fprintf(b, "punch_check_test_duration_seconds_sum{kind=%s} %s\n", label(kind), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "punch_check_test_duration_seconds_count{kind=%s} %d\n", label(kind), count)
+	}
+
+	header("punch_check_relays", "gauge", "Connected relays.")
+	fmt.Fprintf(b, "punch_check_relays %d\n", m.relays)
+	header("punch_check_relays_healthy", "gauge", "Connected relays that can be assigned to clients.")
+	fmt.Fprintf(b, "punch_check_relays_healthy %d\n", m.relaysHealthy)
+	header("punch_check_clients", "gauge", "Connected clients.")
+	fmt.Fprintf(b, "punch_check_clients %d\n", m.clients)
+
+	header("punch_check_protocol_errors_total", "counter", "Invalid or unexpected messages and connection errors, by kind.")
+	kinds := make([]string, 0, len(m.protocolErrors))
+	for kind := range m.protocolErrors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(b, "punch_check_protocol_errors_total{kind=%s} %d\n", label(kind), m.protocolErrors[kind])
+	}
+}
+
+// label returns a quoted Prometheus label value.
+func label(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
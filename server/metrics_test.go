@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+)
+
+// TestMetrics checks that the metrics of the server count completed, failed
+// and interrupted tests and their verdicts.
+func TestMetrics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	s := netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+	if _, err := netsimtest.Check(ctx, client.Options{
+		Transport: clientHost,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client disconnecting during the main tests
+	failCtx, failCancel := context.WithCancel(ctx)
+	defer failCancel()
+	if _, err := netsimtest.Check(failCtx, client.Options{
+		Transport: clientHost,
+		Progress: func(p client.Progress) {
+			if p.Sent > 0 {
+				failCancel()
+			}
+		},
+	}); err == nil {
+		t.Fatal("expected the cancelled test to fail")
+	}
+	netsimtest.WaitMetrics(t, ctx, s, "punch_check_tests_failed_total 1\n")
+
+	// a client disconnecting during the optional tests
+	interruptCtx, interruptCancel := context.WithCancel(ctx)
+	defer interruptCancel()
+	if _, err := netsimtest.Check(interruptCtx, client.Options{
+		Transport: clientHost,
+		Lifetime:  true,
+		Progress: func(p client.Progress) {
+			if strings.HasPrefix(p.Message, "Measuring mapping lifetime") {
+				interruptCancel()
+			}
+		},
+	}); err == nil {
+		t.Fatal("expected the cancelled test to fail")
+	}
+	netsimtest.WaitMetrics(t, ctx, s, "punch_check_tests_interrupted_total 1\n")
+
+	body := netsimtest.Metrics(s)
+	for _, line := range []string{
+		"punch_check_tests_started_total 3\n",
+		"punch_check_tests_completed_total 1\n",
+		"punch_check_tests_failed_total 1\n",
+		`punch_check_test_duration_seconds_count{kind="test"} 2` + "\n",
+		`punch_check_test_duration_seconds_count{kind="rendezvous"} 0` + "\n",
+		`punch_check_verdicts_total{verdict="mapping",value="endpoint-independent"} 2` + "\n",
+		"punch_check_relays 2\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+	// clients closing their connection are not protocol errors
+	if strings.Contains(body, `kind="connection"`) {
+		t.Errorf("metrics contain connection errors:\n%s", body)
+	}
+}
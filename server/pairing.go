@@ -0,0 +1,162 @@
+package server
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+var pairingJoinTimeout = 5 * time.Minute
+var pairingCodeLength = 6
+
+// letters and digits that cannot be confused with each other
+const pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// pairingPort is the index of the client port used for the pairing test
+var pairingPort = 0
+
+// pairing is a pairing session between two clients, which each run a
+// pairingTest: once both clients run it, they discover the public endpoint
+// of their port C0 with C0 -> A0, then send C0 -> C0 of the peer until both
+// directions are received or the test times out. In rendezvous sessions, the
+// test completes once the endpoints are discovered.
+type pairing struct {
+	code       string
+	rendezvous bool
+	clients    [2]*connection // creator, then peer once it joins
+	ready      [2]bool        // whether the client runs its pairing test
+	left       [2]bool        // whether the client disconnected
+	since      time.Time      // time both clients were ready
+	endpoints  [2]*net.UDPAddr
+	received   [2]bool // whether the client received a probe from the other client
+	profiles   [2]*MessageResult
+	done       bool
+}
+
+// newPairingCode returns a random unused pairing code. Codes are not
+// predictable, so that other clients cannot join a pairing session.
+func newPairingCode(pairings map[string]*pairing) (string, error) {
+	for {
+		code := make([]byte, pairingCodeLength)
+		if _, err := crand.Read(code); err != nil {
+			return "", err
+		}
+		for i, b := range code {
+			// the alphabet length divides 256, so letters are uniform
+			code[i] = pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)]
+		}
+		if _, ok := pairings[string(code)]; !ok {
+			return string(code), nil
+		}
+	}
+}
+
+func normalizePairingCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (p *pairing) index(c *connection) int {
+	if p.clients[0] == c {
+		return 0
+	}
+	return 1
+}
+
+// peer returns the other client of the session, or nil.
+func (p *pairing) peer(c *connection) *connection {
+	if p == nil {
+		return nil
+	}
+	return p.clients[1-p.index(c)]
+}
+
+func (p *pairing) leave(c *connection) {
+	p.left[p.index(c)] = true
+}
+
+type pairingTest struct {
+	pairing *pairing
+	index   int
+	since   time.Time
+}
+
+func (t *pairingTest) start(c *connection, result *MessageResult, now time.Time) bool {
+	if c.client.pairing == nil {
+		return false
+	}
+	t.pairing = c.client.pairing
+	t.index = t.pairing.index(c)
+	t.since = now
+	t.pairing.ready[t.index] = true
+	if !t.pairing.rendezvous { // rendezvous clients send their profile
+		profile := *result
+		profile.Pairing = nil
+		t.pairing.profiles[t.index] = &profile
+	}
+	if !t.pairing.ready[1-t.index] {
+		c.send(&MessageInfo{
+			MessageType: 2,
+			Message:     fmt.Sprintf("Waiting for the peer to join with pairing code %s.", t.pairing.code),
+		})
+	}
+	return true
+}
+
+func (t *pairingTest) step(c *connection, now time.Time) bool {
+	p := t.pairing
+	i := t.index
+	j := 1 - i
+	if p.done {
+		return true
+	}
+	if p.left[j] {
+		return true
+	}
+	if !p.ready[j] {
+		return now.Sub(t.since) > pairingJoinTimeout
+	}
+	if p.since.IsZero() {
+		p.since = now
+	}
+	if (p.rendezvous && p.endpoints[0] != nil && p.endpoints[1] != nil) || (p.received[0] && p.received[1]) || now.Sub(p.since) > 2*punchTimeout {
+		p.done = true
+		return true
+	}
+	if p.endpoints[i] == nil {
+		relay := c.client.relays[0]
+		c.Write(c.client.session, c.ports[pairingPort], relay.addr.IP, relay.ports[0]) // C0 -> A0
+	}
+	if peer := p.endpoints[j]; peer != nil && !p.rendezvous {
+		c.Write(c.client.session, c.ports[pairingPort], peer.IP, peer.Port) // C0 -> peer C0
+	}
+	return false
+}
+
+func (t *pairingTest) receive(c *connection, pr probe, now time.Time) {
+	if pr.clientPort != pairingPort {
+		return
+	}
+	if !pr.inbound && pr.relay == 0 && pr.relayPort == 0 { // C0 -> A0
+		t.pairing.endpoints[t.index] = &net.UDPAddr{IP: pr.ip, Port: pr.port}
+	} else if pr.inbound && pr.peer { // peer C0 -> C0
+		t.pairing.received[t.index] = true
+	}
+}
+
+func (t *pairingTest) finish(result *MessageResult) {
+	p := t.pairing
+	j := 1 - t.index
+	result.Pairing = &Pairing{
+		Sent:        p.received[j],
+		Received:    p.received[t.index],
+		PeerProfile: p.profiles[j],
+	}
+	if peer := p.endpoints[j]; peer != nil {
+		result.Pairing.PeerIP = peer.IP
+		result.Pairing.PeerPort = peer.Port
+	}
+}
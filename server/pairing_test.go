@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+)
+
+func TestPairingHolePunch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	portRestricted := netsim.NATConfig{
+		Filtering: AddressAndPortDependent,
+	}
+	symmetric := netsim.NATConfig{
+		Mapping:   AddressAndPortDependent,
+		Filtering: AddressAndPortDependent,
+	}
+	tests := []struct {
+		name     string
+		configs  [2]netsim.NATConfig
+		sent     bool // from the creator to the peer
+		received bool // from the peer to the creator
+	}{
+		{"port restricted cones", [2]netsim.NATConfig{portRestricted, portRestricted}, true, true},
+		{"full cone and symmetric", [2]netsim.NATConfig{{}, symmetric}, false, true},
+		{"symmetric and port restricted cone", [2]netsim.NATConfig{symmetric, portRestricted}, false, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			n := netsim.New(1)
+			netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+			hosts := [2]*netsim.Host{
+				n.AddHost("192.168.0.2", n.AddNAT(test.configs[0], "5.0.0.1")),
+				n.AddHost("192.168.1.2", n.AddNAT(test.configs[1], "6.0.0.1")),
+			}
+
+			codes := make(chan string, 1)
+			var results [2]*MessageResult
+			errs := make(chan error, 2)
+			go func() {
+				var err error
+				results[0], err = netsimtest.Check(ctx, client.Options{
+					Transport: hosts[0],
+					Pair:      true,
+					Progress: func(p client.Progress) {
+						if p.PairingCode != "" {
+							select {
+							case codes <- p.PairingCode:
+							default:
+							}
+						}
+					},
+				})
+				errs <- err
+			}()
+			go func() {
+				var err error
+				select {
+				case code := <-codes:
+					results[1], err = netsimtest.Check(ctx, client.Options{
+						Transport:   hosts[1],
+						PairingCode: code,
+					})
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+				errs <- err
+			}()
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, r := range results {
+				if r.Pairing == nil || len(r.Pairing.PeerIP) == 0 {
+					t.Fatalf("client %d: no pairing result: %s", i, r.String())
+				}
+			}
+			expect := func(name string, got bool, expected bool) {
+				if got != expected {
+					t.Errorf("%s: expected %v, got %v", name, expected, got)
+				}
+			}
+			expect("creator sent", results[0].Pairing.Sent, test.sent)
+			expect("creator received", results[0].Pairing.Received, test.received)
+			expect("peer sent", results[1].Pairing.Sent, test.received)
+			expect("peer received", results[1].Pairing.Received, test.sent)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/classify"
+)
+
+// probe is a probe of a test session, received on a client or relay port.
+type probe struct {
+	inbound    bool   // received by the client, rather than by a relay
+	peer       bool   // sent by the client paired with the receiving client
+	relay      int    // index of the relay (A, B), or -1 for probes between client ports
+	relayPort  int    // index of the relay port
+	clientPort int    // index of the client port, in the ports then the burst ports of the client
+	ip         net.IP // source of the probe, as seen by the receiver
+	port       int
+}
+
+// test is a part of the test plan of a client. Tests send probes from client
+// and relay ports, and interpret the probes they receive.
+type test interface {
+	// start is called when the test starts, with the result of the main tests
+	// for optional tests, and returns false if the test cannot run.
+	start(c *connection, result *MessageResult, now time.Time) bool
+	// step sends the probes of the test, and returns whether it is complete.
+	step(c *connection, now time.Time) bool
+	// receive is called when a probe is received while the test runs.
+	receive(c *connection, p probe, now time.Time)
+	// finish adds the verdicts of the test to the result.
+	finish(result *MessageResult)
+}
+
+// observationTest is embedded by the main tests, which only record their
+// observations in the client, so that they are classified together.
+type observationTest struct{}
+
+func (observationTest) start(c *connection, result *MessageResult, now time.Time) bool {
+	return true
+}
+
+func (observationTest) finish(result *MessageResult) {}
+
+type testInfo struct {
+	name     string
+	optional bool   // only run when requested by the client, after the main tests
+	required bool   // cannot be disabled
+	requires string // test that must run before this one, if any
+	new      func(s *Server) test
+}
+
+// tests are the tests that servers can run, in the order they run.
+var tests = []testInfo{{
+	name:     TestMapping,
+	required: true,
+	new:      func(s *Server) test { return &mappingTest{} },
+}, {
+	name:     TestFiltering,
+	required: true,
+	new:      func(s *Server) test { return &filteringTest{} },
+}, {
+	name: TestHairpinning,
+	new:  func(s *Server) test { return &hairpinningTest{} },
+}, {
+	name: TestBurst,
+	new:  func(s *Server) test { return &burstTest{} },
+}, {
+	name:     TestTCP,
+	optional: true,
+	new:      func(s *Server) test { return &tcpTest{} },
+}, {
+	name:     TestPairing,
+	optional: true,
+	new:      func(s *Server) test { return &pairingTest{} },
+}, {
+	name:     TestLifetime,
+	optional: true,
+	new: func(s *Server) test {
+		return &lifetimeTest{
+			min:        s.lifetimeMin,
+			max:        s.lifetimeMax,
+			resolution: s.lifetimeResolution,
+		}
+	},
+}, {
+	name:     TestRefresh,
+	optional: true,
+	requires: TestLifetime,
+	new:      func(s *Server) test { return &refreshTest{} },
+}}
+
+func findTest(name string) *testInfo {
+	for i := range tests {
+		if tests[i].name == name {
+			return &tests[i]
+		}
+	}
+	return nil
+}
+
+// testPlan runs the tests of a client. The main tests run together until they
+// are complete or time out, then their observations are classified, then the
+// optional tests requested by the client run one after the other.
+type testPlan struct {
+	rendezvous bool // only run the optional tests, without classifying observations
+	timedOut   bool // the main tests timed out before they were complete
+	main       []test
+	untested   []string
+	optional   []test
+	current    int  // index of the running optional test, -1 while the main tests run
+	started    bool // whether the current optional test started
+	result     *MessageResult
+}
+
+func (s *Server) newTestPlan() *testPlan {
+	p := &testPlan{
+		current: -1,
+	}
+	for _, info := range tests {
+		if info.optional {
+			continue
+		}
+		if !s.enabled(info.name) {
+			p.untested = append(p.untested, info.name)
+			continue
+		}
+		p.main = append(p.main, info.new(s))
+	}
+	return p
+}
+
+// newRendezvousPlan returns a plan that only exchanges the public endpoints of
+// paired clients.
+func newRendezvousPlan() *testPlan {
+	return &testPlan{
+		rendezvous: true,
+		optional:   []test{&pairingTest{}},
+		current:    -1,
+	}
+}
+
+// request adds the optional tests requested by the client, and the tests
+// they require. Unknown or disabled tests are skipped and reported as an error.
+func (s *Server) request(p *testPlan, names []string) error {
+	var err error
+	requested := make(map[string]bool)
+	for _, name := range names {
+		info := findTest(name)
+		if info == nil || !info.optional || !s.available(name) {
+			err = fmt.Errorf("unknown test: %q", name)
+			continue
+		}
+		for info != nil {
+			requested[info.name] = true
+			info = findTest(info.requires)
+		}
+	}
+	for _, info := range tests {
+		if requested[info.name] {
+			p.optional = append(p.optional, info.new(s))
+		}
+	}
+	return err
+}
+
+// step advances the plan, and returns whether all tests are complete, in which
+// case p.result is set.
+func (p *testPlan) step(c *connection, now time.Time) bool {
+	if p.current == -1 {
+		if now.Sub(c.client.last) <= punchTimeout {
+			if c.ports == nil {
+				return false
+			}
+			complete := true
+			for _, t := range p.main {
+				if !t.step(c, now) {
+					complete = false
+				}
+			}
+			if !complete {
+				return false
+			}
+		} else {
+			p.timedOut = true
+		}
+		if p.rendezvous {
+			p.result = &MessageResult{
+				IP: c.addr.IP,
+			}
+		} else {
+			p.result = classify.Classify(&c.client.Observations)
+			p.result.Untested = p.untested
+			if p.result.UDPBlocked {
+				return true
+			}
+		}
+		p.current = 0
+	}
+	for p.current < len(p.optional) {
+		t := p.optional[p.current]
+		if !p.started {
+			p.started = true
+			if !t.start(c, p.result, now) {
+				p.current++
+				p.started = false
+				continue
+			}
+		}
+		if !t.step(c, now) {
+			return false
+		}
+		t.finish(p.result)
+		p.current++
+		p.started = false
+	}
+	return true
+}
+
+// connected passes the result of a TCP connection to the running optional
+// test.
+func (p *testPlan) connected(c *connection, m *MessageConnect, now time.Time) {
+	if t, ok := p.running().(tcpReceiver); ok {
+		t.connected(c, m, now)
+	}
+}
+
+// accept passes a TCP connection accepted by a relay to the running optional
+// test.
+func (p *testPlan) accept(c *connection, pr probe, now time.Time) {
+	if t, ok := p.running().(tcpReceiver); ok {
+		t.accept(c, pr, now)
+	}
+}
+
+// running returns the running optional test, or nil.
+func (p *testPlan) running() test {
+	if p.current == -1 || p.current >= len(p.optional) || !p.started {
+		return nil
+	}
+	return p.optional[p.current]
+}
+
+// receive passes a received probe to the running tests.
+func (p *testPlan) receive(c *connection, pr probe, now time.Time) {
+	if p.current == -1 {
+		for _, t := range p.main {
+			t.receive(c, pr, now)
+		}
+	} else if t := p.running(); t != nil {
+		t.receive(c, pr, now)
+	}
+}
@@ -0,0 +1,824 @@
+package server
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/classify"
+)
+
+type event interface{}
+
+type eventNew struct {
+	c         net.Conn
+	w         chan Message
+	certified bool // the peer presented a verified TLS client certificate
+}
+
+type eventClosed struct {
+	c   net.Conn
+	err error
+}
+
+type eventRead struct {
+	c       net.Conn
+	message Message
+}
+
+// connection is a relay or client connection. Connections that are not
+// relays become clients when they send a message other than MessageHello and
+// MessageAuth.
+type connection struct {
+	addr      *net.TCPAddr
+	c         net.Conn
+	w         chan Message
+	ports     []int
+	hello     *MessageHello // nil if the peer uses protocol version 0
+	relay     bool
+	challenge []byte  // relay authentication challenge sent in the server hello
+	client    *client // nil if connection is a relay, or not yet a client
+	closed    bool
+	overflow  bool // the write queue was full, the connection must be closed
+
+	// relay heartbeats
+	pingID    int
+	pingSent  time.Time
+	lastPong  time.Time // initially the connection time
+	unhealthy bool      // the relay was last reported unhealthy
+	rtt       time.Duration
+
+	// relay reachability
+	verified    bool        // the ports of the relay were reached from another relay
+	quarantined bool        // the ports of the relay were not reachable
+	check       *relayCheck // current or last reachability check, nil if none started
+}
+
+func (c *connection) supports(feature string) bool {
+	return c.hello != nil && c.hello.Supports(feature)
+}
+
+// send queues m to be written to c, without blocking the event loop. If the
+// write queue of c is full, m is dropped and c is closed by the event loop.
+func (c *connection) send(m Message) {
+	if c.closed || c.overflow {
+		return
+	}
+	select {
+	case c.w <- m:
+	default:
+		c.overflow = true
+	}
+}
+
+// Write sends a probe from localPort to ip:port, tagged with the test session
+// of the client being tested.
+func (c *connection) Write(session uint64, localPort int, ip net.IP, port int) {
+	c.send(&MessageSend{
+		LocalPort: localPort,
+		IP:        ip,
+		Port:      port,
+		Data:      probeData(localPort, session),
+	})
+}
+
+// probeData returns the payload of a probe sent from localPort.
+func probeData(localPort int, session uint64) []byte {
+	data := make([]byte, 2+8)
+	binary.BigEndian.PutUint16(data, uint16(localPort))
+	binary.BigEndian.PutUint64(data[2:], session)
+	return data
+}
+
+// newSession returns a random test session, which must not be predictable
+// since it is the only way to tell apart the probes of clients sharing an IP.
+func newSession() (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// parseProbe returns the sending local port and the test session of a probe
+// payload returned by probeData.
+func parseProbe(data []byte) (localPort int, session uint64, ok bool) {
+	if len(data) != 2+8 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(data)), binary.BigEndian.Uint64(data[2:]), true
+}
+
+type client struct {
+	classify.Observations
+	session uint64
+	last    time.Time
+	relays  []*connection
+	allowed []net.IP // IPs the relays can send to, opened with MessageSession
+	plan    *testPlan
+	pairing *pairing // nil if the client does not run a pairing test
+	done    bool     // the result was sent
+}
+
+// portIndex returns the index of a client port, in the ports then the burst
+// ports of the client, or -1.
+func (c *connection) portIndex(port int) int {
+	if i := Index(c.ports, port); i != -1 {
+		return i
+	}
+	if i := Index(c.client.BurstPorts, port); i != -1 {
+		return len(c.ports) + i
+	}
+	return -1
+}
+
+var punchTimeout = 5 * time.Second
+
+func (s *Server) process() {
+	defer close(s.stopped)
+	// a ticker rather than a timeout, so that tests still step when events
+	// keep arriving, such as relays retrying failed authentications
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			for key, c := range s.connections { // close clients first, so that they are not notified of relays closing
+				if c.client == nil {
+					continue
+				}
+				s.closeConnection(key, &MessageInfo{
+					MessageType: 0,
+					Message:     "Internal error: Server is shutting down.",
+				})
+			}
+			for key := range s.connections {
+				s.closeConnection(key, nil)
+			}
+			for {
+				select {
+				case event := <-s.events:
+					if e, ok := event.(eventNew); ok {
+						close(e.w)
+					}
+				default:
+					return
+				}
+			}
+		case event := <-s.events:
+			switch e := event.(type) {
+			case eventNew:
+				if _, ok := s.connections[e.c]; ok {
+					break
+				}
+				addr := tcpAddr(e.c.RemoteAddr())
+				c := &connection{
+					addr:     addr,
+					c:        e.c,
+					w:        e.w,
+					lastPong: time.Now(),
+				}
+				if e.certified && len(s.Relays) > 0 && !s.isRelay(addr) {
+					s.protocolError("auth_failed", "rejecting relay %s: certified relay IP is not allowed", addr.IP.String())
+					c.send(&MessageInfo{
+						MessageType: 0,
+						Message:     "Relay authentication failed.",
+					})
+					close(e.w)
+					break
+				}
+				if e.certified || s.RelayKey == nil && s.isRelay(addr) {
+					if s.relayConnected(addr.IP) {
+						s.protocolError("duplicate_relay", "received new event of relay that is already connected: %q", addr.IP.String())
+						c.send(&MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Relay is already connected.",
+						})
+						close(e.w)
+						break
+					}
+					c.relay = true
+				}
+				s.connections[e.c] = c
+			case eventClosed:
+				if _, ok := s.connections[e.c]; ok && e.err != nil && !closedError(e.err) {
+					s.protocolError("connection", "connection closed: %v", e.err)
+				}
+				s.closeConnection(e.c, nil)
+			case eventRead:
+				c, ok := s.connections[e.c]
+				if !ok {
+					break
+				}
+				if !c.relay && c.client == nil && !handshake(e.message) && !s.newClient(e.c, c) {
+					break
+				}
+				switch m := e.message.(type) {
+				case *MessageHello:
+					if c.hello != nil || c.ports != nil {
+						s.protocolError("unexpected_hello", "received unexpected hello message")
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Unexpected hello message.",
+						})
+						break
+					}
+					version, err := m.Negotiate(ProtocolVersion, MinProtocolVersion)
+					if err != nil {
+						s.protocolError("incompatible_version", "rejecting peer %s: %v", c.addr.IP.String(), err)
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     fmt.Sprintf("Incompatible protocol version: server supports versions %d to %d, but this program supports versions %d to %d. Please update punch-check.", MinProtocolVersion, ProtocolVersion, m.MinVersion, m.Version),
+						})
+						break
+					}
+					c.hello = m
+					if s.RelayKey != nil && !c.relay && c.client == nil {
+						c.challenge = make([]byte, 32)
+						if _, err := crand.Read(c.challenge); err != nil {
+							s.logErr.Printf("failed generating relay challenge: %v", err)
+							s.closeConnection(e.c, &MessageInfo{
+								MessageType: 0,
+								Message:     "Internal error: Failed generating relay challenge.",
+							})
+							break
+						}
+					}
+					c.send(&MessageHello{
+						Version:    version,
+						MinVersion: MinProtocolVersion,
+						Features:   s.features,
+						Challenge:  c.challenge,
+					})
+				case *MessageAuth:
+					if c.relay || c.client != nil || c.challenge == nil {
+						s.protocolError("unexpected_auth", "received unexpected auth message")
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Unexpected authentication message.",
+						})
+						break
+					}
+					if !hmac.Equal(m.MAC, RelayMAC(s.RelayKey, c.challenge)) || (len(s.Relays) > 0 && !s.isRelay(c.addr)) {
+						s.protocolError("auth_failed", "rejecting relay %s: authentication failed", c.addr.IP.String())
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Relay authentication failed.",
+						})
+						break
+					}
+					if s.relayConnected(c.addr.IP) {
+						s.protocolError("duplicate_relay", "received auth message of relay that is already connected: %q", c.addr.IP.String())
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Relay is already connected.",
+						})
+						break
+					}
+					c.relay = true
+					c.challenge = nil
+				case *MessagePair:
+					if c.client == nil || c.ports != nil || c.client.pairing != nil {
+						s.protocolError("unexpected_pair", "received unexpected pairing message")
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Unexpected pairing message.",
+						})
+						break
+					}
+					if !s.available(TestPairing) {
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Pairing tests are disabled on this server.",
+						})
+						break
+					}
+					if m.Code == "" {
+						code, err := newPairingCode(s.pairings)
+						if err != nil {
+							s.logErr.Printf("failed generating pairing code: %v", err)
+							s.closeConnection(e.c, &MessageInfo{
+								MessageType: 0,
+								Message:     "Internal error: Failed generating pairing code.",
+							})
+							break
+						}
+						p := &pairing{
+							code:       code,
+							rendezvous: m.Rendezvous,
+						}
+						p.clients[0] = c
+						s.pairings[p.code] = p
+						c.client.pairing = p
+					} else {
+						code := normalizePairingCode(m.Code)
+						p, ok := s.pairings[code]
+						if !ok {
+							s.closeConnection(e.c, &MessageInfo{
+								MessageType: 0,
+								Message:     fmt.Sprintf("Unknown pairing code: %s.", code),
+							})
+							break
+						}
+						if (p.clients[0].addr.IP.To4() != nil) != (c.addr.IP.To4() != nil) {
+							s.closeConnection(e.c, &MessageInfo{
+								MessageType: 0,
+								Message:     "The peer of this pairing code runs its test over another IP version.",
+							})
+							break
+						}
+						if p.rendezvous != m.Rendezvous {
+							s.closeConnection(e.c, &MessageInfo{
+								MessageType: 0,
+								Message:     "The peer of this pairing code uses another pairing mode.",
+							})
+							break
+						}
+						delete(s.pairings, code)
+						p.clients[1] = c
+						c.client.pairing = p
+					}
+					if m.Rendezvous {
+						c.client.plan = newRendezvousPlan()
+						if m.Profile != nil {
+							profile := *m.Profile
+							profile.Pairing = nil
+							c.client.pairing.profiles[c.client.pairing.index(c)] = &profile
+						}
+					}
+					c.send(&MessagePair{
+						Code: c.client.pairing.code,
+					})
+				case *MessagePing:
+					if c.relay {
+						if m.ID > 0 && m.ID <= c.pingID {
+							c.lastPong = time.Now()
+						}
+						if m.ID == c.pingID {
+							c.rtt = c.lastPong.Sub(c.pingSent)
+						}
+						break
+					}
+					s.closeConnection(e.c, &MessageInfo{
+						MessageType: 1,
+						Message:     "OK",
+					})
+				case *MessagePorts:
+					if c.ports != nil {
+						s.protocolError("duplicate_ports", "received duplicate ports message: %v", e.message.Type())
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Unexpected ports message.",
+						})
+						break
+					}
+					var minPorts int
+					if c.client != nil && c.client.plan.rendezvous {
+						minPorts = 1
+					} else if c.client != nil {
+						minPorts = ClientPortsCount
+					} else {
+						minPorts = RelayPortsCount
+					}
+					keepPorts := minPorts
+					if c.client == nil {
+						keepPorts = len(m.Ports) // relays with more ports can be used for more observations
+					}
+					if len(m.Ports) < minPorts {
+						s.protocolError("invalid_ports", "received invalid ports message: not enough ports: want %d, got %d", minPorts, len(m.Ports))
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Invalid ports message: not enough ports.",
+						})
+						break
+					}
+					if !unique(m.Ports) {
+						s.protocolError("invalid_ports", "received invalid ports message: ports are not unique: %v", m.Ports)
+						s.closeConnection(e.c, &MessageInfo{
+							MessageType: 0,
+							Message:     "Internal error: Invalid ports message: ports are not unique.",
+						})
+						break
+					}
+					c.ports = m.Ports[:keepPorts]
+					if c.client != nil {
+						c.client.Ports = c.ports
+						if s.enabled(TestBurst) && !c.client.plan.rendezvous {
+							burst := m.Ports[minPorts:]
+							if len(burst) > burstPortsCount {
+								burst = burst[:burstPortsCount]
+							}
+							c.client.BurstPorts = burst
+							c.client.BurstNATPorts = make([]int, len(burst))
+						}
+					}
+					if c.client != nil && len(m.IP) > 0 {
+						c.client.LocalIP = m.IP
+					}
+					if c.client != nil && !c.client.plan.rendezvous {
+						tests := m.Tests
+						if c.client.pairing != nil {
+							tests = append(tests, TestPairing)
+						}
+						if err := s.request(c.client.plan, tests); err != nil {
+							s.protocolError("invalid_tests", "received ports message with invalid tests: %v", err)
+						}
+					}
+				case *MessageReceive:
+					remotePort, session, ok := parseProbe(m.Data)
+					if !ok {
+						break
+					}
+					if c.relay && c.receiveCheck(session, m.LocalPort) {
+						break
+					}
+					var client *connection
+					var relay *connection
+					var clientPort int
+					var relayPort int
+					p := probe{
+						inbound: c.client != nil,
+						relay:   -1,
+						ip:      m.IP,
+						port:    m.Port,
+					}
+					if ip := p.ip.To4(); ip != nil {
+						p.ip = ip
+					}
+
+					if c.client == nil {
+						relay = c
+						client = s.sessions[session]
+						if client == nil {
+							s.protocolError("invalid_receive", "received invalid receive message: unknown session from client: %s", net.IP(m.IP).String())
+							break
+						}
+						clientPort = remotePort
+						relayPort = m.LocalPort
+					} else {
+						client = c
+						if session != client.client.session {
+							if peer := client.client.pairing.peer(client); peer == nil || session != peer.client.session {
+								s.protocolError("invalid_receive", "received invalid receive message: unknown session from %s", net.IP(m.IP).String())
+								break
+							}
+							p.peer = true
+						}
+						clientPort = m.LocalPort
+						relayPort = m.Port
+						if !p.peer && !client.client.IsPublicIP(m.IP) && !client.addr.IP.Equal(m.IP) { // not C* -> C*
+							for _, r := range c.client.relays {
+								if r.addr.IP.Equal(m.IP) {
+									relay = r
+									break
+								}
+							}
+							if relay == nil {
+								s.protocolError("invalid_receive", "received invalid receive message: unknown relay: %s", net.IP(m.IP).String())
+								break
+							}
+						}
+					}
+
+					if relay != nil {
+						for i, r := range client.client.relays { // <A>0, <B>0
+							if r == relay {
+								p.relay = i
+								break
+							}
+						}
+						if p.relay == -1 {
+							s.protocolError("invalid_receive", "received invalid receive message: unknown relay: %v", net.IP(relay.addr.IP))
+							break
+						}
+						p.relayPort = Index(relay.ports, relayPort) // A<0>, A<1>
+						if p.relayPort == -1 {
+							s.protocolError("invalid_receive", "received invalid receive message: unknown relay port for relay %v: %d", net.IP(relay.addr.IP), relayPort)
+							break
+						}
+					}
+					p.clientPort = client.portIndex(clientPort) // C<0>, C<1>
+					if p.clientPort == -1 {
+						s.protocolError("invalid_receive", "received invalid receive message: unknown client port: %v:%d", net.IP(client.addr.IP), clientPort)
+						break
+					}
+					if !p.inbound {
+						client.allow(p.ip)
+					}
+					client.client.plan.receive(client, p, time.Now())
+				case *MessageConnect:
+					_, session, ok := parseProbe(m.Data)
+					if !ok {
+						break
+					}
+					client := s.sessions[session]
+					if client == nil || (c.client != nil && c != client) {
+						s.protocolError("invalid_connect", "received invalid connect message: unknown session from %s", c.addr.IP.String())
+						break
+					}
+					client.client.plan.connected(client, m, time.Now())
+				case *MessageAccept:
+					clientPort, session, ok := parseProbe(m.Data)
+					if !ok || c.client != nil {
+						break
+					}
+					client := s.sessions[session]
+					if client == nil {
+						s.protocolError("invalid_accept", "received invalid accept message: unknown session from client: %s", net.IP(m.IP).String())
+						break
+					}
+					p := probe{
+						relay:      -1,
+						relayPort:  Index(c.ports, m.LocalPort),
+						clientPort: client.portIndex(clientPort),
+						ip:         m.IP,
+						port:       m.Port,
+					}
+					if ip := p.ip.To4(); ip != nil {
+						p.ip = ip
+					}
+					for i, r := range client.client.relays {
+						if r == c {
+							p.relay = i
+							break
+						}
+					}
+					if p.relay == -1 || p.relayPort == -1 || p.clientPort == -1 {
+						s.protocolError("invalid_accept", "received invalid accept message: unknown relay or port: %s:%d", c.addr.IP.String(), m.LocalPort)
+						break
+					}
+					client.allow(p.ip)
+					client.client.plan.accept(client, p, time.Now())
+				default:
+					s.protocolError("unexpected_message", "received unexpected message type: %v", MessageType(e.message.Type()))
+					s.closeConnection(e.c, &MessageInfo{
+						MessageType: 0,
+						Message:     fmt.Sprintf("Internal error: Invalid message type: %v.", MessageType(e.message.Type())),
+					})
+					break
+				}
+			}
+		case <-ticker.C:
+			now := time.Now()
+			s.heartbeat(now)
+			s.checkRelays(now)
+			s.updateConnections(now)
+			for key, client := range s.connections {
+				if client.client == nil {
+					continue
+				}
+				if client.client.plan.step(client, now) {
+					s.sendResult(key, client.client.plan.result)
+				}
+			}
+		}
+		s.closeOverflowed()
+	}
+}
+
+// closeOverflowed closes the connections whose write queue is full, rather than
+// waiting for them.
+func (s *Server) closeOverflowed() {
+	for key, c := range s.connections {
+		if !c.overflow {
+			continue
+		}
+		if c.relay {
+			s.logErr.Printf("closing relay %s: too many pending messages", c.addr.IP.String())
+		} else {
+			s.logErr.Printf("closing connection %s: too many pending messages", c.addr.String())
+		}
+		s.closeConnection(key, nil)
+	}
+}
+
+// handshake returns whether m can be sent before the connection is known to be
+// a relay or a client.
+func handshake(m Message) bool {
+	switch m.(type) {
+	case *MessageHello, *MessageAuth:
+		return true
+	}
+	return false
+}
+
+// relayConnected returns whether a relay is connected from ip.
+func (s *Server) relayConnected(ip net.IP) bool {
+	for _, relay := range s.connections {
+		if relay.relay && relay.addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newClient makes c a client, or closes it and returns false if not enough
+// relays are available.
+func (s *Server) newClient(key net.Conn, c *connection) bool {
+	ipv4 := c.addr.IP.To4() != nil
+	now := time.Now()
+	loads := make(map[*connection]int)
+	for _, client := range s.connections {
+		if client.client == nil {
+			continue
+		}
+		for _, relay := range client.client.relays {
+			loads[relay]++
+		}
+	}
+	var candidates []*connection
+	var infos []RelayInfo
+	for _, relay := range s.connections {
+		if !relay.relay || (relay.addr.IP.To4() != nil) != ipv4 || !relay.healthy(now) || len(relay.ports) < s.relayPorts {
+			continue
+		}
+		candidates = append(candidates, relay)
+		infos = append(infos, RelayInfo{
+			IP:      relay.addr.IP,
+			Clients: loads[relay],
+			RTT:     relay.rtt,
+		})
+	}
+	var indexes []int
+	if len(candidates) >= s.relays {
+		indexes = s.selection.Select(c.addr.IP, infos, s.relays)
+	}
+	if !validSelection(indexes, s.relays, len(candidates)) {
+		family := "IPv4"
+		if !ipv4 {
+			family = "IPv6"
+		}
+		if relayCount := len(candidates); relayCount < s.relays {
+			s.logErr.Printf("not enough %s relays with %d ports for client connection: want %d, has %d", family, s.relayPorts, s.relays, relayCount)
+		} else {
+			s.logErr.Printf("no suitable %s relays for client connection among %d relays", family, relayCount)
+		}
+		s.metrics.rejected()
+		s.closeConnection(key, &MessageInfo{
+			MessageType: 0,
+			Message:     fmt.Sprintf("Internal error: Not enough %s relays available.", family),
+		})
+		return false
+	}
+	relays := make([]*connection, s.relays)
+	for i, j := range indexes {
+		relays[i] = candidates[j]
+	}
+	var session uint64
+	for {
+		var err error
+		session, err = newSession()
+		if err != nil {
+			s.logErr.Printf("failed generating test session: %v", err)
+			s.closeConnection(key, &MessageInfo{
+				MessageType: 0,
+				Message:     "Internal error: Failed generating test session.",
+			})
+			return false
+		}
+		if _, ok := s.sessions[session]; !ok && session != 0 {
+			break
+		}
+	}
+	natPorts := make([][]int, s.relays)
+	natIPs := make([][]net.IP, s.relays)
+	received := make([][]bool, s.relays)
+	for i := range relays {
+		natPorts[i] = make([]int, s.relayPorts)
+		natIPs[i] = make([]net.IP, s.relayPorts)
+		received[i] = make([]bool, s.relayPorts)
+	}
+	c.client = &client{
+		Observations: classify.Observations{
+			IP:             c.addr.IP,
+			NATPorts:       make([]int, ClientPortsCount),
+			NATIPs:         make([]net.IP, ClientPortsCount),
+			RelayNATPorts:  natPorts,
+			RelayNATIPs:    natIPs,
+			ReceivedRelays: received,
+		},
+		session: session,
+		last:    now,
+		relays:  relays,
+		plan:    s.newTestPlan(),
+	}
+	s.sessions[session] = c
+	c.allow(c.addr.IP)
+	s.metrics.started()
+	return true
+}
+
+// allow opens the test session of client c on its relays for ip, so that they
+// can send to ip.
+func (c *connection) allow(ip net.IP) {
+	for _, allowed := range c.client.allowed {
+		if allowed.Equal(ip) {
+			return
+		}
+	}
+	c.client.allowed = append(c.client.allowed, ip)
+	for _, relay := range c.client.relays {
+		relay.openSession(c.client.session, ip)
+	}
+}
+
+func (s *Server) sendResult(key net.Conn, result *MessageResult) {
+	c, ok := s.connections[key]
+	if !ok {
+		return
+	}
+	c.client.done = true
+	s.metrics.completed(c.client.plan, time.Now().Sub(c.client.last))
+	if c.supports(FeatureResults) {
+		s.closeConnection(key, result)
+	} else {
+		s.closeConnection(key, &MessageInfo{
+			MessageType: 1,
+			Message:     result.String(),
+		})
+	}
+}
+
+func (s *Server) closeConnection(key net.Conn, m Message) {
+	c, ok := s.connections[key]
+	if !ok {
+		return
+	}
+	if m != nil {
+		c.send(m)
+	}
+	c.closed = true
+	close(c.w)
+	if c.overflow {
+		// the writer may be stuck on a half-dead connection, so close it
+		// without waiting for it
+		c.c.Close()
+	}
+	delete(s.connections, key)
+	if !c.relay && c.client == nil {
+		return
+	}
+	if c.client != nil {
+		if !c.client.done {
+			if p := c.client.plan; p.result != nil {
+				s.metrics.interrupted(p, time.Now().Sub(c.client.last))
+			} else {
+				s.metrics.failed()
+			}
+		}
+		delete(s.sessions, c.client.session)
+		for _, relay := range c.client.relays {
+			if s.connections[relay.c] == relay {
+				relay.closeSession(c.client.session)
+			}
+		}
+		if p := c.client.pairing; p != nil {
+			p.leave(c)
+			if p.clients[1] == nil {
+				delete(s.pairings, p.code)
+			}
+		}
+		return
+	}
+	for key, client := range s.connections {
+		if client.client == nil {
+			continue
+		}
+		for _, relay := range client.client.relays {
+			if relay == c {
+				s.closeConnection(key, &MessageInfo{
+					MessageType: 0,
+					Message:     "Internal error: Relay disconnected during the test.",
+				})
+				break
+			}
+		}
+	}
+}
+
+func unique(a []int) bool {
+	for i, v1 := range a {
+		for _, v2 := range a[i+1:] {
+			if v1 == v2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// closedError returns whether err ends a connection that was closed normally,
+// by the peer or locally, rather than a protocol or transport failure.
+func closedError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed") // net.ErrClosed requires Go 1.16
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+// TestWriteOverflow checks that a relay whose write queue is full is closed
+// rather than blocking the event loop.
+func TestWriteOverflow(t *testing.T) {
+	s := &Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	s.init()
+	now := time.Now()
+	newRelay := func(ip string, queue int) (*connection, net.Conn) {
+		local, remote := net.Pipe()
+		c := &connection{
+			addr:     &net.TCPAddr{IP: net.ParseIP(ip), Port: 1},
+			c:        local,
+			w:        make(chan Message, queue),
+			hello:    &MessageHello{Features: []string{FeatureSessions, FeatureHeartbeat}},
+			relay:    true,
+			ports:    []int{1000, 1001},
+			lastPong: now,
+			pingSent: now,
+		}
+		s.connections[local] = c
+		return c, remote
+	}
+	stuck, stuckRemote := newRelay("2.0.0.1", 1)
+	stuck.w <- &MessagePing{} // never written
+	checked, _ := newRelay("3.0.0.1", writeQueueSize)
+
+	done := make(chan struct{})
+	go func() {
+		s.checkRelays(now) // the check of relay 3.0.0.1 opens a session on the stuck relay
+		s.closeOverflowed()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event loop blocked on the stuck relay")
+	}
+	if _, ok := s.connections[stuck.c]; ok {
+		t.Errorf("the stuck relay was not closed")
+	}
+	if _, ok := s.connections[checked.c]; !ok {
+		t.Errorf("the checked relay was closed")
+	}
+	stuckRemote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stuckRemote.Read(make([]byte, 1)); err == nil {
+		t.Errorf("the connection of the stuck relay is still open")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		ports  []int
+		unique bool
+	}{
+		{nil, true},
+		{[]int{1000}, true},
+		{[]int{1000, 1001, 1002}, true},
+		{[]int{1000, 1000}, false},
+		{[]int{1000, 1001, 1002, 1001}, false},
+		{[]int{0, 1, 0}, false},
+	}
+	for _, test := range tests {
+		if u := unique(test.ports); u != test.unique {
+			t.Errorf("%v: expected unique %t, got %t", test.ports, test.unique, u)
+		}
+	}
+}
+
+func TestClosedError(t *testing.T) {
+	tests := []struct {
+		err    error
+		closed bool
+	}{
+		{fmt.Errorf("reading message header: read error: %w", io.EOF), true},
+		{fmt.Errorf("reading message header: read error: %w", io.ErrClosedPipe), true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("use of closed network connection")}, true},
+		{fmt.Errorf("reading message header: read error: %w", io.ErrUnexpectedEOF), false},
+		{fmt.Errorf("reading message: unknown message type: %v", 42), false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false},
+	}
+	for _, test := range tests {
+		if closed := closedError(test.err); closed != test.closed {
+			t.Errorf("%v: expected closed %t, got %t", test.err, test.closed, closed)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+var refreshEstablishTimeout = 5 * time.Second
+var refreshProbeTimeout = 2 * time.Second
+
+// indexes of the client ports used for the refresh test
+var refreshInboundPort = 3
+var refreshOutboundPort = 4
+
+type refreshState int
+
+const (
+	refreshEstablishing refreshState = iota // sending C3 -> A0 and C4 -> A0 until A0 receives them
+	refreshRefreshing                       // sending A0 -> C3 and C4 -> A0 periodically
+	refreshProbing                          // sending A0 -> C3 and A0 -> C4 until C3 and C4 receive them
+)
+
+// refreshTest checks whether mappings are refreshed by inbound and outbound
+// packets, by keeping a mapping C3 -> A0 alive with packets A0 -> C3 only, a
+// mapping C4 -> A0 alive with packets C4 -> A0 only, for longer than the
+// mapping lifetime, then checking which of the mappings are still alive.
+type refreshTest struct {
+	state    refreshState
+	since    time.Time // start of the current state
+	last     time.Time // last refresh
+	interval time.Duration
+	duration time.Duration
+	natIPs   [2]net.IP
+	natPorts [2]int // inbound, outbound
+	lost     bool   // the outbound mapping was recreated with another port
+	received [2]bool
+}
+
+// start configures the test based on the measured mapping lifetime, and
+// returns false if the mapping lifetime is unknown or too long to be tested.
+func (r *refreshTest) start(c *connection, result *MessageResult, now time.Time) bool {
+	lifetime := result.MappingLifetime
+	if lifetime == nil || lifetime.Max == 0 {
+		return false
+	}
+	r.interval = lifetime.Min / 2
+	if r.interval == 0 {
+		r.interval = lifetime.Max / 4
+	}
+	r.duration = 2 * lifetime.Max
+	r.state = refreshEstablishing
+	r.since = now
+	c.send(&MessageInfo{
+		MessageType: 2,
+		Message:     fmt.Sprintf("Testing mapping refresh behavior, this takes %v.", r.duration),
+	})
+	return true
+}
+
+// step advances the test, and returns whether it is complete.
+func (r *refreshTest) step(c *connection, now time.Time) bool {
+	relay := c.client.relays[0]
+	inboundPort := c.ports[refreshInboundPort]
+	outboundPort := c.ports[refreshOutboundPort]
+	switch r.state {
+	case refreshEstablishing:
+		if r.natPorts[0] != 0 && r.natPorts[1] != 0 {
+			r.state = refreshRefreshing
+			r.since = now
+			r.last = now
+			break
+		}
+		if now.Sub(r.since) > refreshEstablishTimeout {
+			return true
+		}
+		if r.natPorts[0] == 0 {
+			c.Write(c.client.session, inboundPort, relay.addr.IP, relay.ports[0])
+		}
+		if r.natPorts[1] == 0 {
+			c.Write(c.client.session, outboundPort, relay.addr.IP, relay.ports[0])
+		}
+	case refreshRefreshing:
+		if now.Sub(r.since) >= r.duration {
+			r.state = refreshProbing
+			r.since = now
+			break
+		}
+		if now.Sub(r.last) >= r.interval {
+			r.last = now
+			relay.Write(c.client.session, relay.ports[0], r.natIPs[0], r.natPorts[0])
+			c.Write(c.client.session, outboundPort, relay.addr.IP, relay.ports[0])
+		}
+	case refreshProbing:
+		if (r.received[0] && r.received[1]) || now.Sub(r.since) > refreshProbeTimeout {
+			return true
+		}
+		if !r.received[0] {
+			relay.Write(c.client.session, relay.ports[0], r.natIPs[0], r.natPorts[0])
+		}
+		if !r.received[1] {
+			relay.Write(c.client.session, relay.ports[0], r.natIPs[1], r.natPorts[1])
+		}
+	}
+	return false
+}
+
+func (r *refreshTest) receive(c *connection, p probe, now time.Time) {
+	if p.relay != 0 || p.relayPort != 0 {
+		return
+	}
+	var i int
+	switch p.clientPort {
+	case refreshInboundPort:
+		i = 0
+	case refreshOutboundPort:
+		i = 1
+	default:
+		return
+	}
+	if p.inbound { // A0 -> C3, A0 -> C4
+		if r.state == refreshProbing {
+			r.received[i] = true
+		}
+	} else if r.natPorts[i] == 0 { // C3 -> A0, C4 -> A0
+		r.natIPs[i] = p.ip
+		r.natPorts[i] = p.port
+	} else if i == 1 && (r.natPorts[i] != p.port || !r.natIPs[i].Equal(p.ip)) {
+		r.lost = true
+	}
+}
+
+// finish adds the inbound and outbound refresh behaviors to the result, if
+// they could be tested.
+func (r *refreshTest) finish(result *MessageResult) {
+	if r.state != refreshProbing {
+		return
+	}
+	in := r.received[0]
+	out := r.received[1] && !r.lost
+	result.InboundRefresh = &in
+	result.OutboundRefresh = &out
+}
@@ -0,0 +1,59 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/server"
+)
+
+// TestMappingRefresh checks that the refresh test reports whether inbound
+// packets refresh mappings.
+func TestMappingRefresh(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	for _, inbound := range []bool{false, true} {
+		inbound := inbound
+		t.Run(fmt.Sprintf("inbound refresh %t", inbound), func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+			defer cancel()
+			n := netsim.New(1)
+			netsimtest.Serve(t, ctx, n, netsimtest.Config{
+				Server: &server.Server{
+					LifetimeMin:        time.Second,
+					LifetimeMax:        8 * time.Second,
+					LifetimeResolution: time.Second,
+					ErrorLog:           netsimtest.Discard,
+				},
+			})
+			clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{
+				Timeout:        3 * time.Second,
+				InboundRefresh: inbound,
+			}, "5.0.0.1"))
+
+			result, err := netsimtest.Check(ctx, client.Options{
+				Transport: clientHost,
+				Refresh:   true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.InboundRefresh == nil || result.OutboundRefresh == nil {
+				t.Fatalf("expected refresh behaviors, got %s", result.String())
+			}
+			if *result.InboundRefresh != inbound {
+				t.Errorf("expected inbound refresh %t, got %t", inbound, *result.InboundRefresh)
+			}
+			if !*result.OutboundRefresh {
+				t.Errorf("expected outbound refresh")
+			}
+		})
+	}
+}
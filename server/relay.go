@@ -0,0 +1,207 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+// relayPingInterval is the interval between heartbeats sent to relays
+var relayPingInterval = 5 * time.Second
+
+// relayPingTimeout is the time after the last heartbeat reply of a relay after
+// which it is unhealthy, and not assigned to new clients
+var relayPingTimeout = 15 * time.Second
+
+// relayDeadTimeout is the time after the last heartbeat reply of a relay after
+// which its connection is closed
+var relayDeadTimeout = 60 * time.Second
+
+// relayCheckTimeout is the maximum duration of the reachability check of the
+// ports of a relay
+var relayCheckTimeout = 5 * time.Second
+
+// relayCheckInterval is the interval between reachability checks of a relay
+// whose ports are not reachable
+var relayCheckInterval = time.Minute
+
+// relayRecheckInterval is the interval between reachability checks of a relay
+// whose ports were reachable, so that relays whose UDP path breaks later are
+// quarantined too
+var relayRecheckInterval = 5 * time.Minute
+
+// relayCheck is a reachability check of the ports of a relay, in which another
+// relay sends to its ports.
+type relayCheck struct {
+	session uint64
+	from    *connection
+	since   time.Time
+	reached []bool // by port index
+	done    bool
+}
+
+// healthy returns whether relay c can be assigned to new clients: its ports
+// are reachable, and it replies to heartbeats.
+func (c *connection) healthy(now time.Time) bool {
+	if c.ports == nil || !c.verified {
+		return false
+	}
+	return !c.supports(FeatureHeartbeat) || now.Sub(c.lastPong) <= relayPingTimeout
+}
+
+// heartbeat pings relays, and closes the relays that stopped replying.
+func (s *Server) heartbeat(now time.Time) {
+	for key, c := range s.connections {
+		if !c.relay || !c.supports(FeatureHeartbeat) {
+			continue
+		}
+		since := now.Sub(c.lastPong)
+		if since > relayDeadTimeout {
+			s.logErr.Printf("closing relay %s: no heartbeat reply for %v", c.addr.IP.String(), since)
+			c.overflow = true // the writer may be stuck, do not wait for it
+			s.closeConnection(key, nil)
+			continue
+		}
+		if healthy := since <= relayPingTimeout; healthy != !c.unhealthy {
+			c.unhealthy = !healthy
+			if c.unhealthy {
+				s.logErr.Printf("relay %s is unhealthy: no heartbeat reply for %v", c.addr.IP.String(), since)
+			} else {
+				s.logErr.Printf("relay %s is healthy again", c.addr.IP.String())
+			}
+		}
+		if now.Sub(c.pingSent) >= relayPingInterval {
+			c.pingID++
+			c.pingSent = now
+			c.send(&MessagePing{
+				ID: c.pingID,
+			})
+		}
+	}
+}
+
+// checkRelays checks that the ports of the relays that registered are
+// reachable from other relays, then periodically checks them again, and
+// quarantines the relays whose ports are not reachable.
+func (s *Server) checkRelays(now time.Time) {
+	for _, c := range s.connections {
+		if !c.relay || c.ports == nil {
+			continue
+		}
+		interval := relayCheckInterval
+		if c.verified {
+			interval = relayRecheckInterval
+		}
+		check := c.check
+		if check == nil || (check.done && now.Sub(check.since) >= interval) {
+			s.startCheck(c, now)
+			continue
+		}
+		if check.done {
+			continue
+		}
+		if s.connections[check.from.c] != check.from { // the other relay left
+			check.done = true
+			check.since = time.Time{}
+			continue
+		}
+		var unreached []int
+		for i, reached := range check.reached {
+			if !reached {
+				unreached = append(unreached, c.ports[i])
+			}
+		}
+		if len(unreached) > 0 && now.Sub(check.since) <= relayCheckTimeout {
+			for _, port := range unreached {
+				check.from.Write(check.session, check.from.ports[0], c.addr.IP, port)
+			}
+			continue
+		}
+		check.done = true
+		check.from.closeSession(check.session)
+		if len(unreached) == 0 {
+			c.verified = true
+			if c.quarantined {
+				s.logErr.Printf("relay %s is no longer quarantined: its ports are reachable", c.addr.IP.String())
+			}
+			c.quarantined = false
+			continue
+		}
+		c.verified = false
+		if !c.quarantined {
+			s.logErr.Printf("quarantining relay %s: its UDP ports %v are not reachable from relay %s, retrying in %v", c.addr.IP.String(), unreached, check.from.addr.IP.String(), relayCheckInterval)
+		}
+		c.quarantined = true
+	}
+}
+
+// startCheck starts a reachability check of relay c from a random other relay
+// of the same IP family, preferably a verified one, if any.
+func (s *Server) startCheck(c *connection, now time.Time) {
+	ipv4 := c.addr.IP.To4() != nil
+	var peers []*connection
+	var verified []*connection
+	for _, relay := range s.connections {
+		if relay == c || !relay.relay || relay.ports == nil || (relay.addr.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		peers = append(peers, relay)
+		if relay.verified {
+			verified = append(verified, relay)
+		}
+	}
+	if len(verified) > 0 {
+		peers = verified
+	}
+	if len(peers) == 0 {
+		return
+	}
+	session, err := newSession()
+	if err != nil {
+		s.logErr.Printf("failed generating relay check session: %v", err)
+		return
+	}
+	check := &relayCheck{
+		session: session,
+		from:    peers[rand.Intn(len(peers))],
+		since:   now,
+		reached: make([]bool, len(c.ports)),
+	}
+	c.check = check
+	check.from.openSession(check.session, c.addr.IP)
+}
+
+// receiveCheck handles a packet received by relay c, and returns whether it was
+// sent for a reachability check of c.
+func (c *connection) receiveCheck(session uint64, localPort int) bool {
+	if c.check == nil || c.check.session != session {
+		return false
+	}
+	if i := Index(c.ports, localPort); i != -1 {
+		c.check.reached[i] = true
+	}
+	return true
+}
+
+// openSession allows relay c to send to ip for session, if it restricts its
+// destinations.
+func (c *connection) openSession(session uint64, ip net.IP) {
+	if c.supports(FeatureSessions) {
+		c.send(&MessageSession{
+			Session: session,
+			IP:      ip,
+		})
+	}
+}
+
+// closeSession closes session on relay c.
+func (c *connection) closeSession(session uint64) {
+	if c.supports(FeatureSessions) {
+		c.send(&MessageSession{
+			Session: session,
+			Closed:  true,
+		})
+	}
+}
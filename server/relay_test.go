@@ -0,0 +1,172 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/relay"
+	"github.com/delthas/punch-check/server"
+)
+
+// TestRelayReachability checks that relays whose ports are not reachable are
+// not assigned to clients.
+func TestRelayReachability(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	selection := &recordingSelection{}
+	s := &server.Server{
+		RelayKey:       []byte("secret"),
+		RelaySelection: selection,
+		ErrorLog:       netsimtest.Discard,
+	}
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{Server: s})
+	firewall := n.AddNAT(netsim.NATConfig{
+		Filtering: AddressAndPortDependent,
+	}, "4.0.0.1")
+	firewalled := &relay.Relay{
+		Server:       netsimtest.ServerAddress,
+		Ports:        []int{1000, 1001},
+		RetryTimeout: 10 * time.Millisecond,
+		Key:          []byte("secret"),
+		Transport:    n.AddHost("192.168.1.2", firewall),
+		ErrorLog:     netsimtest.Discard,
+	}
+	go firewalled.Run(ctx)
+	netsimtest.WaitMetrics(t, ctx, s, "punch_check_relays 3\n")
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+
+	for i := 0; i < 3; i++ {
+		result, err := netsimtest.Check(ctx, client.Options{
+			Transport: clientHost,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		netsimtest.ExpectBehaviors(t, result, EndpointIndependent, EndpointIndependent)
+	}
+	offered := selection.get()
+	if len(offered) == 0 {
+		t.Fatal("no relays were offered to the selection")
+	}
+	for _, ip := range offered {
+		if ip.Equal(net.IPv4(4, 0, 0, 1)) {
+			t.Fatalf("unreachable relay was offered to the selection: %v", offered)
+		}
+	}
+	if body := netsimtest.Metrics(s); !strings.Contains(body, "punch_check_relays_healthy 2\n") {
+		t.Errorf("unreachable relay is counted as healthy:\n%s", body)
+	}
+}
+
+// recordingSelection is a random relay selection that records the IPs of the
+// relays it was offered.
+type recordingSelection struct {
+	mutex   sync.Mutex
+	offered []net.IP
+}
+
+func (r *recordingSelection) Select(client net.IP, relays []server.RelayInfo, count int) []int {
+	r.mutex.Lock()
+	for _, relay := range relays {
+		r.offered = append(r.offered, relay.IP)
+	}
+	r.mutex.Unlock()
+	return server.RandomSelection{}.Select(client, relays, count)
+}
+
+func (r *recordingSelection) get() []net.IP {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]net.IP(nil), r.offered...)
+}
+
+// TestRelayHeartbeat checks that relays that stop replying to heartbeats are
+// not assigned to clients, and do not block the server.
+func TestRelayHeartbeat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	s := netsimtest.Serve(t, ctx, n, netsimtest.Config{
+		Server: &server.Server{
+			RelayKey: []byte("secret"),
+			ErrorLog: netsimtest.Discard,
+		},
+	})
+	transport := &pausableTransport{
+		Host:   n.AddHost("4.0.0.1", nil),
+		paused: make(chan struct{}),
+		resume: make(chan struct{}),
+	}
+	defer close(transport.resume)
+	r := &relay.Relay{
+		Server:       netsimtest.ServerAddress,
+		Ports:        []int{1000, 1001},
+		RetryTimeout: 10 * time.Millisecond,
+		Key:          []byte("secret"),
+		Transport:    transport,
+		ErrorLog:     netsimtest.Discard,
+	}
+	go r.Run(ctx)
+	netsimtest.WaitMetrics(t, ctx, s, "punch_check_relays_healthy 3\n")
+	close(transport.paused)
+	netsimtest.WaitMetrics(t, ctx, s, "punch_check_relays_healthy 2\n")
+
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+	for i := 0; i < 3; i++ {
+		result, err := netsimtest.Check(ctx, client.Options{
+			Transport: clientHost,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		netsimtest.ExpectBehaviors(t, result, EndpointIndependent, EndpointIndependent)
+	}
+	if body := netsimtest.Metrics(s); !strings.Contains(body, "punch_check_relays 3\n") {
+		t.Errorf("paused relay was disconnected before the dead timeout:\n%s", body)
+	}
+}
+
+// pausableTransport is a relay transport whose control connections stop
+// reading once paused is closed, as a relay that is connected but stuck.
+type pausableTransport struct {
+	*netsim.Host
+	paused chan struct{}
+	resume chan struct{}
+}
+
+func (t *pausableTransport) Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	c, err := t.Host.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &pausableConn{Conn: c, t: t}, nil
+}
+
+type pausableConn struct {
+	net.Conn
+	t *pausableTransport
+}
+
+func (c *pausableConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.t.paused:
+		<-c.t.resume
+	default:
+	}
+	return c.Conn.Read(b)
+}
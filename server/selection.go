@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RelayInfo describes a relay available for a client test.
+type RelayInfo struct {
+	IP      net.IP
+	Clients int           // number of clients the relay is currently assigned to
+	RTT     time.Duration // round-trip time of the relay heartbeats, 0 if unknown
+}
+
+// RelaySelection picks the relays of client tests.
+type RelaySelection interface {
+	// Select returns the indexes in relays of count distinct relays to assign
+	// to a client, or nil if no suitable relays are available.
+	Select(client net.IP, relays []RelayInfo, count int) []int
+}
+
+// RelaySelections are the names of the relay selection strategies, for
+// NewRelaySelection.
+var RelaySelections = []string{"random", "least-loaded", "distinct-subnet", "latency", "groups", "pinned"}
+
+// NewRelaySelection returns the relay selection strategy of a name of
+// RelaySelections. The "groups" and "pinned" strategies read their
+// configuration from config, see ParseRelayGroups and ParseRelaySets.
+func NewRelaySelection(name string, config io.Reader) (RelaySelection, error) {
+	switch name {
+	case "random":
+		return RandomSelection{}, nil
+	case "least-loaded":
+		return LeastLoadedSelection{}, nil
+	case "distinct-subnet":
+		return SubnetSelection{}, nil
+	case "latency":
+		return LatencySelection{}, nil
+	case "groups", "pinned":
+		if config == nil {
+			return nil, fmt.Errorf("relay selection %q requires a configuration", name)
+		}
+		if name == "groups" {
+			groups, err := ParseRelayGroups(config)
+			if err != nil {
+				return nil, err
+			}
+			return GroupSelection{Groups: groups}, nil
+		}
+		sets, err := ParseRelaySets(config)
+		if err != nil {
+			return nil, err
+		}
+		return PinnedSelection{Sets: sets}, nil
+	default:
+		return nil, fmt.Errorf("unknown relay selection: %q", name)
+	}
+}
+
+// RandomSelection picks relays at random.
+type RandomSelection struct{}
+
+func (RandomSelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	if len(relays) < count {
+		return nil
+	}
+	return rand.Perm(len(relays))[:count]
+}
+
+// LeastLoadedSelection picks the relays assigned to the fewest clients.
+type LeastLoadedSelection struct{}
+
+func (LeastLoadedSelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	if len(relays) < count {
+		return nil
+	}
+	indexes := rand.Perm(len(relays)) // break ties at random
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return relays[indexes[i]].Clients < relays[indexes[j]].Clients
+	})
+	return indexes[:count]
+}
+
+// LatencySelection picks the relays with the lowest heartbeat round-trip time,
+// as a proxy for their load and network health.
+type LatencySelection struct{}
+
+func (LatencySelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	if len(relays) < count {
+		return nil
+	}
+	indexes := rand.Perm(len(relays))
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := relays[indexes[i]].RTT, relays[indexes[j]].RTT
+		if a == 0 || b == 0 { // unknown RTTs last
+			return a != 0 && b == 0
+		}
+		return a < b
+	})
+	return indexes[:count]
+}
+
+// SubnetSelection picks relays in distinct /24 IPv4 or /48 IPv6 subnets, so
+// that the address-dependent tests are not weakened by relays sharing a
+// network. Clients are not assigned relays if not enough subnets are
+// available.
+type SubnetSelection struct{}
+
+func (SubnetSelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	return selectDistinct(relays, count, func(relay RelayInfo) string {
+		if ip := relay.IP.To4(); ip != nil {
+			return ip.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return relay.IP.Mask(net.CIDRMask(48, 128)).String()
+	})
+}
+
+// RelayGroup is a named group of relay networks, such as the networks of an
+// autonomous system.
+type RelayGroup struct {
+	Name     string
+	Networks []*net.IPNet
+}
+
+// GroupSelection picks relays in distinct groups, or no relays if not enough
+// groups are available. Relays in no group are each in their own group.
+type GroupSelection struct {
+	Groups []RelayGroup
+}
+
+func (s GroupSelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	return selectDistinct(relays, count, func(relay RelayInfo) string {
+		for _, g := range s.Groups {
+			for _, n := range g.Networks {
+				if n.Contains(relay.IP) {
+					return "group " + g.Name
+				}
+			}
+		}
+		return relay.IP.String()
+	})
+}
+
+// PinnedSelection only picks relays together with other relays of their set:
+// it picks random available relays of a random set with enough available
+// relays.
+type PinnedSelection struct {
+	Sets [][]net.IP
+}
+
+func (s PinnedSelection) Select(client net.IP, relays []RelayInfo, count int) []int {
+	for _, i := range rand.Perm(len(s.Sets)) {
+		set := s.Sets[i]
+		var indexes []int
+		for _, k := range rand.Perm(len(set)) {
+			for j, relay := range relays {
+				if relay.IP.Equal(set[k]) {
+					indexes = append(indexes, j)
+					break
+				}
+			}
+		}
+		if len(indexes) >= count {
+			return indexes[:count]
+		}
+	}
+	return nil
+}
+
+// validSelection returns whether indexes are count distinct indexes of n
+// relays.
+func validSelection(indexes []int, count int, n int) bool {
+	if len(indexes) != count {
+		return false
+	}
+	seen := make(map[int]bool, count)
+	for _, i := range indexes {
+		if i < 0 || i >= n || seen[i] {
+			return false
+		}
+		seen[i] = true
+	}
+	return true
+}
+
+// selectDistinct picks relays with distinct keys at random, or nil if not
+// enough keys are available.
+func selectDistinct(relays []RelayInfo, count int, key func(relay RelayInfo) string) []int {
+	var indexes []int
+	keys := make(map[string]bool)
+	for _, i := range rand.Perm(len(relays)) {
+		k := key(relays[i])
+		if keys[k] {
+			continue
+		}
+		keys[k] = true
+		indexes = append(indexes, i)
+	}
+	if len(indexes) < count {
+		return nil
+	}
+	return indexes[:count]
+}
+
+// ParseRelayGroups parses relay groups from lines of a group name followed by
+// the IPs or CIDR networks of the group, separated by spaces. Empty lines and
+// # comments are ignored.
+func ParseRelayGroups(r io.Reader) ([]RelayGroup, error) {
+	lines, err := parseLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var groups []RelayGroup
+	for _, fields := range lines {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid relay group %q: no networks", fields[0])
+		}
+		g := RelayGroup{
+			Name: fields[0],
+		}
+		for _, f := range fields[1:] {
+			n, err := parseNetwork(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid relay group %q: %v", g.Name, err)
+			}
+			g.Networks = append(g.Networks, n)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// ParseRelaySets parses pinned relay sets from lines of relay IPs separated by
+// spaces. Empty lines and # comments are ignored.
+func ParseRelaySets(r io.Reader) ([][]net.IP, error) {
+	lines, err := parseLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var sets [][]net.IP
+	for _, fields := range lines {
+		var set []net.IP
+		for _, f := range fields {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid relay set: invalid IP %q", f)
+			}
+			set = append(set, ip)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseLines returns the space-separated fields of the lines of r, skipping
+// empty lines and # comments.
+func parseLines(r io.Reader) ([][]string, error) {
+	var lines [][]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading relay selection configuration: %v", err)
+	}
+	return lines, nil
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func relayInfos(ips ...string) []RelayInfo {
+	relays := make([]RelayInfo, len(ips))
+	for i, ip := range ips {
+		relays[i].IP = net.ParseIP(ip)
+	}
+	return relays
+}
+
+func TestRelaySelection(t *testing.T) {
+	loaded := relayInfos("2.0.0.1", "3.0.0.1", "4.0.0.1", "5.0.0.1")
+	for i, clients := range []int{3, 0, 2, 0} {
+		loaded[i].Clients = clients
+	}
+	latencies := relayInfos("2.0.0.1", "3.0.0.1", "4.0.0.1", "5.0.0.1")
+	for i, rtt := range []time.Duration{0, 30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		latencies[i].RTT = rtt
+	}
+	unknownLatencies := relayInfos("2.0.0.1", "3.0.0.1", "4.0.0.1")
+	unknownLatencies[2].RTT = 5 * time.Millisecond
+	_, as1, _ := net.ParseCIDR("2.0.0.0/8")
+
+	tests := []struct {
+		name      string
+		selection RelaySelection
+		relays    []RelayInfo
+		count     int
+		want      []int   // expected indexes, in any order, if set
+		among     [][]int // groups of indexes of which exactly one is expected, if set
+		none      bool    // no selection expected
+	}{{
+		name:      "random",
+		selection: RandomSelection{},
+		relays:    relayInfos("2.0.0.1", "3.0.0.1", "4.0.0.1"),
+		count:     2,
+	}, {
+		name:      "random with too few relays",
+		selection: RandomSelection{},
+		relays:    relayInfos("2.0.0.1"),
+		count:     2,
+		none:      true,
+	}, {
+		name:      "least-loaded",
+		selection: LeastLoadedSelection{},
+		relays:    loaded,
+		count:     2,
+		want:      []int{1, 3},
+	}, {
+		name:      "least-loaded with ties",
+		selection: LeastLoadedSelection{},
+		relays:    loaded,
+		count:     3,
+		want:      []int{1, 2, 3},
+	}, {
+		name:      "latency",
+		selection: LatencySelection{},
+		relays:    latencies,
+		count:     2,
+		want:      []int{2, 3},
+	}, {
+		name:      "latency with unknown RTTs",
+		selection: LatencySelection{},
+		relays:    unknownLatencies,
+		count:     2,
+		among:     [][]int{{2}, {0, 1}},
+	}, {
+		name:      "distinct subnets",
+		selection: SubnetSelection{},
+		relays:    relayInfos("2.0.0.1", "2.0.0.2", "3.0.0.1"),
+		count:     2,
+		among:     [][]int{{0, 1}, {2}},
+	}, {
+		name:      "distinct IPv6 subnets",
+		selection: SubnetSelection{},
+		relays:    relayInfos("2001:db8::1", "2001:db8:0:1::1", "2001:db9::1"),
+		count:     2,
+		among:     [][]int{{0, 1}, {2}},
+	}, {
+		name:      "same subnet",
+		selection: SubnetSelection{},
+		relays:    relayInfos("2.0.0.1", "2.0.0.2", "2.0.0.3"),
+		count:     2,
+		none:      true,
+	}, {
+		name: "groups",
+		selection: GroupSelection{Groups: []RelayGroup{{
+			Name:     "as1",
+			Networks: []*net.IPNet{as1},
+		}}},
+		relays: relayInfos("2.0.0.1", "2.1.0.1", "3.0.0.1"),
+		count:  2,
+		among:  [][]int{{0, 1}, {2}},
+	}, {
+		name: "same group",
+		selection: GroupSelection{Groups: []RelayGroup{{
+			Name:     "as1",
+			Networks: []*net.IPNet{as1},
+		}}},
+		relays: relayInfos("2.0.0.1", "2.1.0.1", "2.2.0.1"),
+		count:  2,
+		none:   true,
+	}, {
+		name:      "ungrouped relays",
+		selection: GroupSelection{},
+		relays:    relayInfos("2.0.0.1", "2.0.0.2"),
+		count:     2,
+		want:      []int{0, 1},
+	}, {
+		name: "pinned",
+		selection: PinnedSelection{Sets: [][]net.IP{
+			{net.ParseIP("2.0.0.1"), net.ParseIP("3.0.0.1")},
+		}},
+		relays: relayInfos("4.0.0.1", "3.0.0.1", "2.0.0.1"),
+		count:  2,
+		want:   []int{1, 2},
+	}, {
+		name: "pinned set with a relay down",
+		selection: PinnedSelection{Sets: [][]net.IP{
+			{net.ParseIP("2.0.0.1"), net.ParseIP("3.0.0.1")},
+			{net.ParseIP("4.0.0.1"), net.ParseIP("5.0.0.1")},
+		}},
+		relays: relayInfos("2.0.0.1", "4.0.0.1", "5.0.0.1"),
+		count:  2,
+		want:   []int{1, 2},
+	}, {
+		name: "pinned larger set",
+		selection: PinnedSelection{Sets: [][]net.IP{
+			{net.ParseIP("2.0.0.1"), net.ParseIP("3.0.0.1"), net.ParseIP("4.0.0.1")},
+		}},
+		relays: relayInfos("3.0.0.1", "4.0.0.1", "5.0.0.1"),
+		count:  2,
+		want:   []int{0, 1},
+	}, {
+		name: "pinned without available set",
+		selection: PinnedSelection{Sets: [][]net.IP{
+			{net.ParseIP("2.0.0.1"), net.ParseIP("3.0.0.1")},
+		}},
+		relays: relayInfos("2.0.0.1", "4.0.0.1"),
+		count:  2,
+		none:   true,
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ { // selections are random
+				indexes := test.selection.Select(nil, test.relays, test.count)
+				if test.none {
+					if indexes != nil {
+						t.Fatalf("expected no selection, got %v", indexes)
+					}
+					continue
+				}
+				if !validSelection(indexes, test.count, len(test.relays)) {
+					t.Fatalf("invalid selection: %v", indexes)
+				}
+				sorted := append([]int(nil), indexes...)
+				sort.Ints(sorted)
+				if test.want != nil && !equalInts(sorted, test.want) {
+					t.Fatalf("expected %v, got %v", test.want, sorted)
+				}
+				for _, group := range test.among {
+					n := 0
+					for _, i := range indexes {
+						for _, j := range group {
+							if i == j {
+								n++
+							}
+						}
+					}
+					if n != 1 {
+						t.Fatalf("expected one relay of %v, got %v", group, indexes)
+					}
+				}
+			}
+		})
+	}
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseRelaySelection(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"random", "", false},
+		{"least-loaded", "", false},
+		{"distinct-subnet", "", false},
+		{"latency", "", false},
+		{"unknown", "", true},
+		{"groups", "# relays by AS\nas1 2.0.0.0/8 3.0.0.1 # comment\n\nas2 2001:db8::/32\n", false},
+		{"groups", "as1\n", true},
+		{"groups", "as1 2.0.0.0/33\n", true},
+		{"groups", "as1 invalid\n", true},
+		{"pinned", "2.0.0.1 3.0.0.1\n# comment\n4.0.0.1 5.0.0.1 6.0.0.1\n", false},
+		{"pinned", "2.0.0.1 invalid\n", true},
+	}
+	for _, test := range tests {
+		_, err := NewRelaySelection(test.name, strings.NewReader(test.config))
+		if (err != nil) != test.err {
+			t.Errorf("%s %q: expected error %t, got %v", test.name, test.config, test.err, err)
+		}
+	}
+	for _, name := range []string{"groups", "pinned"} {
+		if _, err := NewRelaySelection(name, nil); err == nil {
+			t.Errorf("%s: expected an error without configuration", name)
+		}
+	}
+
+	groups, err := ParseRelayGroups(strings.NewReader("as1 2.0.0.0/8 3.0.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Name != "as1" || len(groups[0].Networks) != 2 || !groups[0].Networks[1].Contains(net.ParseIP("3.0.0.1")) || groups[0].Networks[1].Contains(net.ParseIP("3.0.0.2")) {
+		t.Errorf("unexpected groups: %+v", groups)
+	}
+	sets, err := ParseRelaySets(strings.NewReader("2.0.0.1 3.0.0.1\n4.0.0.1 5.0.0.1 6.0.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 || len(sets[0]) != 2 || len(sets[1]) != 3 || !sets[1][2].Equal(net.ParseIP("6.0.0.1")) {
+		t.Errorf("unexpected sets: %v", sets)
+	}
+}
@@ -1,118 +1,223 @@
-package main
+// Package server implements the punch-check server, which coordinates relays
+// and clients to test the NAT of clients.
+package server
 
 import (
-	"encoding/binary"
-	"flag"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
-	"math/rand"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	. "github.com/delthas/punch-check"
 )
 
-type event interface{}
+var DefaultPort = 17485
 
-type eventNew struct {
-	c *net.TCPConn
-	w chan Message
-}
+var ErrServerClosed = errors.New("server: Server closed")
 
-type eventClosed struct {
-	c   *net.TCPConn
-	err error
-}
+// tlsHandshakeTimeout is the maximum duration of the TLS handshake of
+// connections of TLS listeners
+var tlsHandshakeTimeout = 10 * time.Second
 
-type eventRead struct {
-	c       *net.TCPConn
-	message Message
-}
+// writeQueueSize is the maximum number of messages queued for writing to each
+// connection, past which the connection is closed rather than waited for
+var writeQueueSize = 1024
 
-type connection struct {
-	addr   *net.TCPAddr
-	c      *net.TCPConn
-	w      chan Message
-	ports  []int
-	client *client // nil if connection is a relay
-}
+type Server struct {
+	// Relays is the list of IPs allowed to connect as relays. If RelayKey is
+	// set and Relays is not empty, relays must also connect from one of these
+	// IPs.
+	//
+	// If Serve is passed a TLS listener that verifies client certificates,
+	// connections with a verified certificate are also relays, and Relays, if
+	// not empty, restricts the IPs they can connect from.
+	Relays []net.IP
+	// RelayKey, if set, is the pre-shared key relays must authenticate with.
+	RelayKey []byte
+	// RelaySelection, if set, picks the relays of client tests. Defaults to
+	// RandomSelection.
+	RelaySelection RelaySelection
+	// ClientRelays is the number of relays assigned to each client, and
+	// RelayPorts the number of ports of each relay used in its tests. More
+	// relays and ports give more observations of the mapping and filtering
+	// verdicts. They default to, and cannot be lower than, ClientRelaysCount
+	// and RelayPortsCount.
+	ClientRelays int
+	RelayPorts   int
+	// LifetimeMin and LifetimeMax are the bounds of the binary search of the
+	// mapping lifetime test, which stops once the lifetime is known within
+	// LifetimeResolution. They default to 10 seconds, 10 minutes and 10
+	// seconds.
+	LifetimeMin        time.Duration
+	LifetimeMax        time.Duration
+	LifetimeResolution time.Duration
+	// ErrorLog, if set, receives error logs. Defaults to logging to stderr.
+	ErrorLog *log.Logger
+	// DisabledTests are the names of the tests the server does not run, among
+	// TestHairpinning, TestBurst, TestTCP, TestPairing, TestLifetime and
+	// TestRefresh.
+	DisabledTests []string
 
-func (c *connection) Write(localPort int, ip net.IP, port int) {
-	data := make([]byte, 2)
-	binary.BigEndian.PutUint16(data, uint16(localPort))
-	c.w <- &MessageSend{
-		LocalPort: localPort,
-		IP:        ip,
-		Port:      port,
-		Data:      data,
-	}
-}
+	initOnce    sync.Once
+	logErr      *log.Logger
+	disabled    map[string]bool
+	selection   RelaySelection
+	metrics     *metrics
+	relays      int // relays per client
+	relayPorts  int // ports per relay
+	features    []string
+	pairings    map[string]*pairing // by code, until the peer joins
+	events      chan event
+	connections map[net.Conn]*connection
+	sessions    map[uint64]*connection
 
-type client struct {
-	last                      time.Time
-	relays                    []*connection
-	natPorts                  []int
-	natPortDependentPort      int
-	natEndpointDependentPort  int
-	received                  bool
-	receivedPortDependent     bool
-	receivedEndpointDependent bool
-	receivedHairpinning       bool
+	lifetimeMin        time.Duration
+	lifetimeMax        time.Duration
+	lifetimeResolution time.Duration
+
+	mutex      sync.Mutex
+	listeners  map[net.Listener]struct{}
+	processing bool
+	closed     bool
+	done       chan struct{}
+	stopped    chan struct{}
 }
 
-func (c *client) Done() bool {
-	for _, port := range c.natPorts {
-		if port == 0 {
-			return false
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.logErr = s.ErrorLog
+		if s.logErr == nil {
+			s.logErr = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
 		}
-	}
-	if c.natPortDependentPort == 0 || c.natEndpointDependentPort == 0 {
-		return false
-	}
-	if !c.received || !c.receivedPortDependent || !c.receivedEndpointDependent || !c.receivedHairpinning {
-		return false
-	}
-	return true
+		s.selection = s.RelaySelection
+		if s.selection == nil {
+			s.selection = RandomSelection{}
+		}
+		s.relays = s.ClientRelays
+		if s.relays < ClientRelaysCount {
+			s.relays = ClientRelaysCount
+		}
+		s.relayPorts = s.RelayPorts
+		if s.relayPorts < RelayPortsCount {
+			s.relayPorts = RelayPortsCount
+		}
+		s.lifetimeMin = s.LifetimeMin
+		if s.lifetimeMin <= 0 {
+			s.lifetimeMin = lifetimeMin
+		}
+		s.lifetimeMax = s.LifetimeMax
+		if s.lifetimeMax <= 0 {
+			s.lifetimeMax = lifetimeMax
+		}
+		s.lifetimeResolution = s.LifetimeResolution
+		if s.lifetimeResolution <= 0 {
+			s.lifetimeResolution = lifetimeResolution
+		}
+		s.metrics = newMetrics()
+		s.disabled = make(map[string]bool)
+		for _, name := range s.DisabledTests {
+			info := findTest(name)
+			if info == nil {
+				s.logErr.Printf("ignoring unknown disabled test: %q", name)
+			} else if info.required {
+				s.logErr.Printf("ignoring disabled test %q: test cannot be disabled", name)
+			} else {
+				s.disabled[name] = true
+			}
+		}
+		for _, feature := range Features {
+			if !s.available(feature) { // optional tests are advertised as features
+				continue
+			}
+			s.features = append(s.features, feature)
+		}
+		s.events = make(chan event, 1000)
+		s.connections = make(map[net.Conn]*connection)
+		s.sessions = make(map[uint64]*connection)
+		s.pairings = make(map[string]*pairing)
+		s.listeners = make(map[net.Listener]struct{})
+		s.done = make(chan struct{})
+		s.stopped = make(chan struct{})
+	})
 }
 
-var punchTimeout = 5 * time.Second
-
-var logErr = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
-var logDebug = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
-
-var allowedRelays []net.IP
-
-var defaultServerPort = 17485
-
-var events = make(chan event, 1000)
-var connections = make(map[*net.TCPConn]*connection)
+// Serve accepts connections from relays and clients on l. It blocks until l
+// fails or the server is shut down, in which case it returns ErrServerClosed.
+// Serve may be called several times with different listeners. l can be a TLS
+// listener, as returned by tls.NewListener.
+func (s *Server) Serve(l net.Listener) error {
+	s.init()
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	if !s.processing {
+		s.processing = true
+		go s.process()
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+	}()
 
-func acceptConnections(l *net.TCPListener) {
 	for {
-		c, err := l.AcceptTCP()
+		c, err := l.Accept()
 		if err != nil {
-			break
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			return err
 		}
-		c.SetNoDelay(true)
-		w := make(chan Message)
-		events <- eventNew{
-			c: c,
-			w: w,
+		if c, ok := c.(*net.TCPConn); ok {
+			c.SetNoDelay(true)
 		}
+		w := make(chan Message, writeQueueSize)
 		go func() {
+			certified := false
+			if tc, ok := c.(*tls.Conn); ok {
+				tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+				if err := tc.Handshake(); err != nil {
+					s.logErr.Printf("failed TLS handshake with %v: %v", c.RemoteAddr(), err)
+					close(w)
+					return
+				}
+				tc.SetDeadline(time.Time{})
+				certified = len(tc.ConnectionState().VerifiedChains) > 0
+			}
+			if !s.send(eventNew{
+				c:         c,
+				w:         w,
+				certified: certified,
+			}) {
+				close(w)
+				return
+			}
 			for {
 				m, err := ReadMessage(c)
 				if err != nil {
-					events <- eventClosed{
+					s.send(eventClosed{
 						c:   c,
 						err: err,
-					}
+					})
 					return
 				}
-				events <- eventRead{
+				if !s.send(eventRead{
 					c:       c,
 					message: m,
+				}) {
+					return
 				}
 			}
 		}()
@@ -125,424 +230,96 @@ func acceptConnections(l *net.TCPListener) {
 	}
 }
 
-func isRelay(addr *net.TCPAddr) bool {
-	for _, relay := range allowedRelays {
-		if relay.Equal(addr.IP) {
-			return true
-		}
+// ListenAndServe listens on the TCP address addr and then calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
-	return false
+	return s.Serve(l)
 }
 
-func main() {
-	serverPort := flag.Int("port", defaultServerPort, "port to listen on")
-	var allowedRelayHosts []string
-	flag.Var((*StringSliceFlag)(&allowedRelayHosts), "relay", "relay hostname/ip (pass multiple times for multiple relays)")
-	flag.Parse()
-
-	if len(allowedRelayHosts) < ClientRelaysCount {
-		fmt.Fprintf(os.Stderr, "at least %d relays are required (use -relay)\n", ClientRelaysCount)
-		flag.Usage()
-		return
+// Shutdown stops accepting connections, closes all connections, and waits for
+// the server to stop, or until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.init()
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
 	}
-
-	allowedRelays = make([]net.IP, len(allowedRelayHosts))
-	for i, relayHost := range allowedRelayHosts {
-		addr, err := net.ResolveIPAddr("ip4", relayHost)
-		if err != nil {
-			logErr.Fatalf("failed resolving relay host %q: %v", relayHost, err)
-		}
-		allowedRelays[i] = addr.IP
+	for l := range s.listeners {
+		l.Close()
 	}
-
-	l, err := net.ListenTCP("tcp4", &net.TCPAddr{
-		Port: *serverPort,
-	})
-	if err != nil {
-		logErr.Fatalf("failed creating control server socket on port %d: %v", *serverPort, err)
+	processing := s.processing
+	s.mutex.Unlock()
+	if !processing {
+		return nil
+	}
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	go acceptConnections(l)
-
-	process()
 }
 
-func process() {
-	for {
-		select {
-		case event := <-events:
-			switch e := event.(type) {
-			case eventNew:
-				if _, ok := connections[e.c]; ok {
-					break
-				}
-				addr := e.c.RemoteAddr().(*net.TCPAddr)
-				var data *client
-				if isRelay(addr) {
-					for _, relay := range connections {
-						if relay.client != nil {
-							continue
-						}
-						if relay.addr.IP.Equal(addr.IP) {
-							logErr.Printf("received new event of relayed that is already connected: %q", addr.IP.String())
-							e.w <- &MessageInfo{
-								MessageType: 0,
-								Message:     "Internal error: Relay is already connected.",
-							}
-							close(e.w)
-						}
-					}
-				} else {
-					relayCount := 0
-					for _, relay := range connections {
-						if relay.client != nil {
-							continue
-						}
-						relayCount++
-					}
-					if relayCount < ClientRelaysCount {
-						logErr.Printf("not enough relays for client connection: want %d, has %d", ClientRelaysCount, relayCount)
-						e.w <- &MessageInfo{
-							MessageType: 0,
-							Message:     "Internal error: Not enough relays available.",
-						}
-						close(e.w)
-						break
-					}
-					relayIndexes := make(map[int]struct{}, ClientRelaysCount)
-					for i := 0; i < ClientRelaysCount; i++ {
-						relay := rand.Intn(relayCount)
-						for {
-							if _, ok := relayIndexes[relay]; !ok {
-								break
-							}
-							relay = rand.Intn(relayCount)
-						}
-						relayIndexes[relay] = struct{}{}
-					}
-					relays := make([]*connection, ClientRelaysCount)
-					i := 0
-					ri := 0
-					for _, relay := range connections {
-						if relay.client != nil {
-							continue
-						}
-						if _, ok := relayIndexes[ri]; ok {
-							relays[i] = relay
-							i++
-						}
-						ri++
-					}
-					data = &client{
-						last:     time.Now(),
-						relays:   relays,
-						natPorts: make([]int, ClientPortsCount),
-					}
-				}
-				connections[e.c] = &connection{
-					addr:   addr,
-					c:      e.c,
-					w:      e.w,
-					client: data,
-				}
-			case eventClosed:
-				if _, ok := connections[e.c]; ok && e.err != nil {
-					logErr.Printf("connection closed: %v", e.err)
-				}
-				closeConnection(e.c, nil)
-			case eventRead:
-				c, ok := connections[e.c]
-				if !ok {
-					break
-				}
-				switch m := e.message.(type) {
-				case *MessagePing:
-					closeConnection(e.c, &MessageInfo{
-						MessageType: 1,
-						Message:     "OK",
-					})
-				case *MessagePorts:
-					if c.ports != nil {
-						logErr.Printf("received duplicate ports message: %v", e.message.Type())
-						closeConnection(e.c, &MessageInfo{
-							MessageType: 0,
-							Message:     "Internal error: Unexpected ports message.",
-						})
-						break
-					}
-					var minPorts int
-					if c.client != nil {
-						minPorts = ClientPortsCount
-					} else {
-						minPorts = RelayPortsCount
-					}
-					if len(m.Ports) < minPorts {
-						logErr.Printf("received invalid ports message: not enough ports: want %d, got %d", minPorts, len(m.Ports))
-						closeConnection(e.c, &MessageInfo{
-							MessageType: 0,
-							Message:     "Internal error: Invalid ports message: not enough ports.",
-						})
-						break
-					}
-					if !unique(m.Ports) {
-						logErr.Printf("received invalid ports message: ports are not unique: %v", m.Ports)
-						closeConnection(e.c, &MessageInfo{
-							MessageType: 0,
-							Message:     "Internal error: Invalid ports message: ports are not unique.",
-						})
-						break
-					}
-					c.ports = m.Ports[:minPorts]
-				case *MessageReceive:
-					if len(m.Data) != 2 {
-						break
-					}
-					remotePort := int(binary.BigEndian.Uint16(m.Data))
-					var client *connection
-					var relay *connection
-					var clientPort int
-					var clientNatPort int
-					var relayPort int
-
-					if c.client == nil {
-						relay = c
-						for _, c := range connections {
-							if c.client != nil && c.addr.IP.Equal(m.IP) {
-								client = c
-								break
-							}
-						}
-						if client == nil {
-							logErr.Printf("received invalid receive message: unknown client: %s", net.IP(m.IP).String())
-							break
-						}
-						clientPort = remotePort
-						clientNatPort = m.Port
-						relayPort = m.LocalPort
-					} else {
-						client = c
-						if client.addr.IP.Equal(m.IP) {
-							if m.LocalPort == client.ports[1] && m.Port == client.client.natPorts[2] {
-								client.client.receivedHairpinning = true
-							}
-							break
-						}
-						for _, r := range c.client.relays {
-							if r.addr.IP.Equal(m.IP) {
-								relay = r
-								break
-							}
-						}
-						if relay == nil {
-							logErr.Printf("received invalid receive message: unknown relay: %s", net.IP(m.IP).String())
-							break
-						}
-						clientPort = m.LocalPort
-						relayPort = m.Port
-					}
-
-					relayIndex := -1 // <A>0, <B>0
-					for i, r := range client.client.relays {
-						if r == relay {
-							relayIndex = i
-							break
-						}
-					}
-					if relayIndex == -1 {
-						logErr.Printf("received invalid receive message: unknown relay: %v", net.IP(relay.addr.IP))
-						break
-					}
+func (s *Server) send(e event) bool {
+	select {
+	case s.events <- e:
+		return true
+	case <-s.done:
+		return false
+	}
+}
 
-					clientPortIndex := Index(client.ports, clientPort) // C<0>, C<1>
-					if clientPortIndex == -1 {
-						logErr.Printf("received invalid receive message: unknown client port: %v:%d", net.IP(client.addr.IP), clientPort)
-						break
-					}
-					relayPortIndex := Index(relay.ports, relayPort) // A<0>, A<1>
-					if relayPortIndex == -1 {
-						logErr.Printf("received invalid receive message: unknown relay port for relay %v: %d", net.IP(relay.addr.IP), relayPort)
-						break
-					}
+func (s *Server) enabled(test string) bool {
+	return !s.disabled[test]
+}
 
-					if c.client == nil {
-						if relayIndex == 0 && relayPortIndex == 0 { // C* -> A0
-							client.client.natPorts[clientPortIndex] = clientNatPort
-						} else if clientPortIndex == 0 {
-							if relayIndex == 0 && relayPortIndex == 1 { // C0 -> A1
-								client.client.natPortDependentPort = clientNatPort
-							} else if relayIndex == 1 && relayPortIndex == 0 { // C0 -> B0
-								client.client.natEndpointDependentPort = clientNatPort
-							}
-						}
-					} else {
-						if clientPortIndex == 1 {
-							if relayIndex == 0 && relayPortIndex == 0 { // A0 -> C1
-								client.client.received = true
-							} else if relayIndex == 0 && relayPortIndex == 1 { // A1 -> C1
-								client.client.receivedPortDependent = true
-							} else if relayIndex == 1 && relayPortIndex == 0 { // B0 -> C1
-								client.client.receivedEndpointDependent = true
-							}
-						}
-					}
-				default:
-					logErr.Printf("received unexpected message type: %v", MessageType(e.message.Type()))
-					closeConnection(e.c, &MessageInfo{
-						MessageType: 0,
-						Message:     fmt.Sprintf("Internal error: Invalid message type: %v.", MessageType(e.message.Type())),
-					})
-					break
-				}
-			}
-		case <-time.After(50 * time.Millisecond):
-			now := time.Now()
-			for key, client := range connections {
-				if client.client == nil {
-					continue
-				}
-				if now.Sub(client.client.last) > punchTimeout || client.client.Done() {
-					var message string
-					if !client.client.received || client.client.natPorts[0] == 0 {
-						message = "Test failed. UDP is blocked."
-					} else {
-						message = "Test complete.\n"
-						var filtering string
-						if client.client.receivedEndpointDependent {
-							filtering = "endpoint-independent"
-						} else if client.client.receivedPortDependent {
-							filtering = "address-dependent"
-						} else {
-							filtering = "address and port-dependent"
-						}
-						holepunching := false
-						var mapping string
-						if client.client.natEndpointDependentPort == client.client.natPorts[0] {
-							holepunching = true
-							mapping = "endpoint-independent"
-						} else if client.client.natPortDependentPort == client.client.natPorts[0] {
-							mapping = "address-dependent"
-						} else {
-							mapping = "address and port-dependent"
-						}
-						parity := true
-						preserved := true
-						contiguous := true
-						last := 0
-						for i, port := range client.ports {
-							natPort := client.client.natPorts[i]
-							if natPort == 0 {
-								last = 0
-								continue
-							}
-							if port%2 != natPort%2 {
-								parity = false
-							}
-							if port != natPort {
-								preserved = false
-							}
-							if last != 0 && last != natPort+1 {
-								contiguous = false
-							}
-							last = natPort
-						}
-						if holepunching {
-							message += "Hole-punching is supported.\n"
-						} else {
-							message += "Hole-punching is NOT supported.\n"
-						}
-						message += fmt.Sprintf("Filtering: %s.\nMapping: %s.\n", filtering, mapping)
-						if client.client.receivedHairpinning {
-							message += "Hairpinning is supported.\n"
-						}
-						if parity {
-							message += "Assignment preserves parity.\n"
-						}
-						if preserved {
-							message += "Assignment preserves local port.\n"
-						}
-						if contiguous {
-							message += "Assignment preserves contiguity.\n"
-						}
-					}
-					closeConnection(key, &MessageInfo{
-						MessageType: 1,
-						Message:     message,
-					})
-					continue
-				}
-				if client.ports == nil {
-					continue
-				}
-				for i := len(client.ports) - 1; i >= 0; i-- { // C* -> A0
-					// send in reverse order to check both assignment contiguity and preservation
-					clientPort := client.ports[i]
-					relay := client.client.relays[0]
-					client.Write(clientPort, relay.addr.IP, relay.ports[0])
-				}
-				{ // C0 -> A1
-					relay := client.client.relays[0]
-					client.Write(client.ports[0], relay.addr.IP, relay.ports[1])
-				}
-				{ // C0 -> B0
-					relay := client.client.relays[1]
-					client.Write(client.ports[0], relay.addr.IP, relay.ports[0])
-				}
-				natPort := client.client.natPorts[1]
-				if natPort != 0 {
-					{
-						relay := client.client.relays[0]
-						relay.Write(relay.ports[0], client.addr.IP, natPort) // A0 -> C1
-						relay.Write(relay.ports[1], client.addr.IP, natPort) // A1 -> C1
-					}
-					{
-						relay := client.client.relays[1]
-						relay.Write(relay.ports[0], client.addr.IP, natPort) // B0 -> C1
-					}
-				}
-				if client.client.natPorts[1] != 0 && client.client.natPorts[2] != 0 {
-					client.Write(client.ports[1], client.addr.IP, client.client.natPorts[2]) // C1 -> C2
-					client.Write(client.ports[2], client.addr.IP, client.client.natPorts[1]) // C2 -> C1
-				}
-			}
+// available returns whether a test and the tests it requires are enabled.
+func (s *Server) available(test string) bool {
+	for info := findTest(test); info != nil; info = findTest(info.requires) {
+		if !s.enabled(info.name) {
+			return false
 		}
 	}
+	return true
 }
 
-func closeConnection(key *net.TCPConn, info *MessageInfo) {
-	c, ok := connections[key]
-	if !ok {
-		return
-	}
-	if info != nil {
-		c.w <- info
-	}
-	close(c.w)
-	delete(connections, key)
-	if c.client != nil {
-		return
-	}
-	for key, client := range connections {
-		if client.client == nil {
-			continue
-		}
-		for _, relay := range client.client.relays {
-			if relay == c {
-				closeConnection(key, &MessageInfo{
-					MessageType: 0,
-					Message:     "Internal error: Relay disconnected during the test.",
-				})
-				break
-			}
+func (s *Server) isRelay(addr *net.TCPAddr) bool {
+	for _, relay := range s.Relays {
+		if relay.Equal(addr.IP) {
+			return true
 		}
 	}
+	return false
 }
 
-func unique(a []int) bool {
-	for i, v1 := range a {
-		for v2 := range a[i+1:] {
-			if v1 == v2 {
-				return false
+// tcpAddr returns addr as a TCP address, with IPv4 addresses in their 4-byte
+// representation.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			return &net.TCPAddr{
+				IP:   ip,
+				Port: addr.Port,
+				Zone: addr.Zone,
 			}
 		}
+		return addr
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: port,
 	}
-	return true
 }
@@ -0,0 +1,277 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/server"
+)
+
+func TestClassification(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	tests := []struct {
+		name      string
+		config    netsim.NATConfig
+		publicIPs []string
+		check     func(t *testing.T, r *MessageResult)
+	}{{
+		name: "full cone",
+		config: netsim.NATConfig{
+			Hairpinning: true,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, EndpointIndependent, EndpointIndependent)
+			if !r.Hairpinning {
+				t.Errorf("hairpinning not detected")
+			}
+			if !r.HolePunching() {
+				t.Errorf("hole punching not supported")
+			}
+		},
+	}, {
+		name: "restricted cone",
+		config: netsim.NATConfig{
+			Filtering: AddressDependent,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, EndpointIndependent, AddressDependent)
+			if r.Hairpinning {
+				t.Errorf("hairpinning detected")
+			}
+		},
+	}, {
+		name: "port restricted cone",
+		config: netsim.NATConfig{
+			Filtering: AddressAndPortDependent,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, EndpointIndependent, AddressAndPortDependent)
+			if !r.HolePunching() {
+				t.Errorf("hole punching not supported")
+			}
+		},
+	}, {
+		name: "address dependent mapping",
+		config: netsim.NATConfig{
+			Mapping:   AddressDependent,
+			Filtering: AddressAndPortDependent,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, AddressDependent, AddressAndPortDependent)
+		},
+	}, {
+		name: "symmetric",
+		config: netsim.NATConfig{
+			Mapping:   AddressAndPortDependent,
+			Filtering: AddressAndPortDependent,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, AddressAndPortDependent, AddressAndPortDependent)
+			if r.HolePunching() {
+				t.Errorf("hole punching supported")
+			}
+		},
+	}, {
+		name: "port preservation",
+		config: netsim.NATConfig{
+			Allocation: netsim.AllocationPreserve,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			if !r.PreservesPort || !r.PreservesParity {
+				t.Errorf("port preservation not detected: port %v, parity %v", r.PreservesPort, r.PreservesParity)
+			}
+		},
+	}, {
+		name: "sequential allocation",
+		config: netsim.NATConfig{
+			Mapping:    AddressAndPortDependent,
+			Allocation: netsim.AllocationSequential,
+			BasePort:   20001,
+			Delta:      2,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			if r.PreservesPort {
+				t.Errorf("port preservation detected")
+			}
+			if r.PortPrediction == nil || r.PortPrediction.Delta != 2 {
+				t.Errorf("expected port prediction with delta 2, got %v", r.PortPrediction)
+			}
+		},
+	}, {
+		name: "arbitrary pooling",
+		config: netsim.NATConfig{
+			Allocation: netsim.AllocationRandom,
+			Pooling:    PoolingArbitrary,
+		},
+		publicIPs: []string{"5.0.0.1", "5.0.0.2"},
+		check: func(t *testing.T, r *MessageResult) {
+			if r.Pooling != PoolingArbitrary {
+				t.Errorf("expected pooling %q, got %q", PoolingArbitrary, r.Pooling)
+			}
+		},
+	}, {
+		name: "packet loss",
+		config: netsim.NATConfig{
+			Filtering: AddressAndPortDependent,
+			Loss:      0.2,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			netsimtest.ExpectBehaviors(t, r, EndpointIndependent, AddressAndPortDependent)
+		},
+	}, {
+		name: "udp blocked",
+		config: netsim.NATConfig{
+			Loss: 1,
+		},
+		check: func(t *testing.T, r *MessageResult) {
+			if !r.UDPBlocked {
+				t.Errorf("blocked UDP not detected")
+			}
+		},
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			publicIPs := test.publicIPs
+			if publicIPs == nil {
+				publicIPs = []string{"5.0.0.1"}
+			}
+			r := netsimtest.Run(t, test.config, publicIPs...)
+			test.check(t, r)
+			if t.Failed() {
+				t.Logf("result: %s", r.String())
+			}
+		})
+	}
+}
+
+// TestSharedIP checks that concurrent tests of clients behind the same NAT
+// get the results of their own probes.
+func TestSharedIP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+	nat := n.AddNAT(netsim.NATConfig{
+		Filtering: AddressAndPortDependent,
+	}, "5.0.0.1")
+	hosts := []*netsim.Host{
+		n.AddHost("192.168.0.2", nat),
+		n.AddHost("192.168.0.3", nat),
+	}
+
+	results := make([]*MessageResult, len(hosts))
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h *netsim.Host) {
+			defer wg.Done()
+			results[i], errs[i] = netsimtest.Check(ctx, client.Options{
+				Transport: h,
+			})
+		}(i, h)
+	}
+	wg.Wait()
+	for i, h := range hosts {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		r := results[i]
+		netsimtest.ExpectBehaviors(t, r, EndpointIndependent, AddressAndPortDependent)
+		if !net.IP(r.LocalIP).Equal(h.IP()) {
+			t.Errorf("client %d: expected local IP %v, got %v", i, h.IP(), net.IP(r.LocalIP))
+		}
+	}
+	for _, port := range results[0].NATPorts {
+		if Index(results[1].NATPorts, port) != -1 {
+			t.Errorf("clients share NAT port %d: %v, %v", port, results[0].NATPorts, results[1].NATPorts)
+		}
+	}
+}
+
+// TestMoreRelays checks the classification of tests with more than two relays
+// and relay ports.
+func TestMoreRelays(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{
+		Server: &server.Server{
+			ClientRelays: 3,
+			RelayPorts:   3,
+			ErrorLog:     netsimtest.Discard,
+		},
+		RelayIPs:   []string{"2.0.0.1", "3.0.0.1", "4.0.0.1"},
+		RelayPorts: []int{1000, 1001, 1002},
+	})
+	nat := n.AddNAT(netsim.NATConfig{
+		Mapping:   AddressDependent,
+		Filtering: AddressDependent,
+	}, "5.0.0.1")
+
+	result, err := netsimtest.Check(ctx, client.Options{
+		Transport: n.AddHost("192.168.0.2", nat),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	netsimtest.ExpectBehaviors(t, result, AddressDependent, AddressDependent)
+	if c := result.Confidence; c == nil || c.Relays != 3 || c.RelayPorts != 3 || c.Mapping != 1 || c.Filtering != 1 {
+		t.Errorf("expected full confidence over 3 relays with 3 ports, got %+v", c)
+	}
+}
+
+// TestIPv6 checks a client behind an IPv6 NAT, with a server and relays
+// reachable over IPv6 only.
+func TestIPv6(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{
+		ServerIP: "2001:db8:1::1",
+		RelayIPs: []string{"2001:db8:2::1", "2001:db8:3::1"},
+	})
+	nat := n.AddNAT(netsim.NATConfig{
+		Filtering: AddressAndPortDependent,
+	}, "2001:db8:5::1")
+	clientHost := n.AddHost("fd00::2", nat)
+	r, err := netsimtest.Check(ctx, client.Options{
+		Server:    "[2001:db8:1::1]:17485",
+		Transport: clientHost,
+		IPv6:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	netsimtest.ExpectBehaviors(t, r, EndpointIndependent, AddressAndPortDependent)
+	public := net.ParseIP("2001:db8:5::1")
+	if !net.IP(r.IP).Equal(public) || !net.IP(r.UDPIP).Equal(public) {
+		t.Errorf("expected public IP %v, got %v and UDP IP %v", public, net.IP(r.IP), net.IP(r.UDPIP))
+	}
+	if !net.IP(r.LocalIP).Equal(clientHost.IP()) {
+		t.Errorf("expected local IP %v, got %v", clientHost.IP(), net.IP(r.LocalIP))
+	}
+	if len(r.NATPorts) != len(r.Ports) || r.NATPorts[0] == 0 {
+		t.Errorf("expected NAT ports for %v, got %v", r.Ports, r.NATPorts)
+	}
+}
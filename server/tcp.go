@@ -0,0 +1,215 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	. "github.com/delthas/punch-check"
+)
+
+// tcpTimeout is the maximum duration of each step of the TCP test
+var tcpTimeout = 2 * TCPConnectTimeout
+
+// tcpReceiver is implemented by tests that open TCP connections.
+type tcpReceiver interface {
+	// connected is called when a client or relay replies to a MessageConnect.
+	connected(c *connection, m *MessageConnect, now time.Time)
+	// accept is called when a relay accepts a TCP connection from the client.
+	accept(c *connection, p probe, now time.Time)
+}
+
+type tcpMapping struct {
+	clientPort int
+	relay      int
+	relayPort  int
+}
+
+// tcpTest runs the TCP behavior tests of RFC 5382. First, the client connects
+// C0 -> A0, A1, B0 to observe the mapping behavior, and C1 -> A0, C2 -> A0.
+// Then A1 and B0 connect to the mapping of C1 to observe the filtering
+// behavior, B1 connects to an unmapped NAT port, and C2 -> B1 and B1 -> the
+// mapping of C2 are opened at the same time, as in TCP hole punching. C2 and
+// B1 both listen, so these are ordinary connects rather than a simultaneous
+// open.
+type tcpTest struct {
+	since    time.Time
+	step2    bool
+	ids      int
+	pending  map[int]func(r ConnectResult)
+	mappings map[tcpMapping]*net.TCPAddr
+	expected []tcpMapping // mappings of the connections the client opened
+
+	filteringPort     ConnectResult // A1 -> C1
+	filteringEndpoint ConnectResult // B0 -> C1
+	unsolicited       ConnectResult // B1 -> unmapped NAT port
+	openClient        ConnectResult // C2 -> B1
+	openRelay         ConnectResult // B1 -> C2
+}
+
+func (t *tcpTest) start(c *connection, result *MessageResult, now time.Time) bool {
+	for _, r := range c.client.relays {
+		if !r.supports(FeatureTCP) {
+			result.Untested = append(result.Untested, TestTCP)
+			return false
+		}
+	}
+	t.since = now
+	t.pending = make(map[int]func(r ConnectResult))
+	t.mappings = make(map[tcpMapping]*net.TCPAddr)
+	c.send(&MessageInfo{
+		MessageType: 2,
+		Message:     "Testing TCP behavior.",
+	})
+	a := c.client.relays[0]
+	b := c.client.relays[1]
+	t.connect(c, c, 0, a.addr.IP, a.ports[0], t.expect(tcpMapping{clientPort: 0, relay: 0, relayPort: 0})) // C0 -> A0
+	t.connect(c, c, 0, a.addr.IP, a.ports[1], t.expect(tcpMapping{clientPort: 0, relay: 0, relayPort: 1})) // C0 -> A1
+	t.connect(c, c, 0, b.addr.IP, b.ports[0], t.expect(tcpMapping{clientPort: 0, relay: 1, relayPort: 0})) // C0 -> B0
+	t.connect(c, c, 1, a.addr.IP, a.ports[0], t.expect(tcpMapping{clientPort: 1, relay: 0, relayPort: 0})) // C1 -> A0
+	t.connect(c, c, 2, a.addr.IP, a.ports[0], t.expect(tcpMapping{clientPort: 2, relay: 0, relayPort: 0})) // C2 -> A0
+	return true
+}
+
+// expect returns a connection callback that waits for the relay to report the
+// mapping of the connection, if it was established.
+func (t *tcpTest) expect(m tcpMapping) func(r ConnectResult) {
+	return func(r ConnectResult) {
+		if r == ConnectConnected {
+			t.expected = append(t.expected, m)
+		}
+	}
+}
+
+// connect asks from to open a TCP connection from its port of index
+// localPort, and calls f with the result.
+func (t *tcpTest) connect(c *connection, from *connection, localPort int, ip net.IP, port int, f func(r ConnectResult)) {
+	t.ids++
+	t.pending[t.ids] = f
+	from.send(&MessageConnect{
+		ID:        t.ids,
+		LocalPort: from.ports[localPort],
+		IP:        ip,
+		Port:      port,
+		Data:      probeData(from.ports[localPort], c.client.session),
+	})
+}
+
+func (t *tcpTest) step(c *connection, now time.Time) bool {
+	if now.Sub(t.since) <= tcpTimeout && (len(t.pending) > 0 || !t.accepted()) {
+		return false
+	}
+	if t.step2 {
+		return true
+	}
+	t.step2 = true
+	t.since = now
+	t.pending = make(map[int]func(r ConnectResult))
+	if t.mappings[tcpMapping{clientPort: 0, relay: 0, relayPort: 0}] == nil {
+		return true
+	}
+	a := c.client.relays[0]
+	b := c.client.relays[1]
+	if m := t.mappings[tcpMapping{clientPort: 1, relay: 0, relayPort: 0}]; m != nil {
+		t.connect(c, a, 1, m.IP, m.Port, func(r ConnectResult) { // A1 -> C1
+			t.filteringPort = r
+		})
+		t.connect(c, b, 0, m.IP, m.Port, func(r ConnectResult) { // B0 -> C1
+			t.filteringEndpoint = r
+		})
+		t.connect(c, b, 1, m.IP, t.unmappedPort(c), func(r ConnectResult) { // B1 -> unmapped NAT port
+			t.unsolicited = r
+		})
+	}
+	if m := t.mappings[tcpMapping{clientPort: 2, relay: 0, relayPort: 0}]; m != nil {
+		t.connect(c, b, 1, m.IP, m.Port, func(r ConnectResult) { // B1 -> C2
+			t.openRelay = r
+		})
+		t.connect(c, c, 2, b.addr.IP, b.ports[1], func(r ConnectResult) { // C2 -> B1
+			t.openClient = r
+		})
+	}
+	return len(t.pending) == 0
+}
+
+// unmappedPort returns a NAT port that neither the control connection nor the
+// observed TCP mappings of the client use: the middle of the largest range of
+// ports between them, so that a NAT allocating ports sequentially is unlikely
+// to have mapped it either.
+func (t *tcpTest) unmappedPort(c *connection) int {
+	used := []int{1023, 65536, c.addr.Port}
+	for _, m := range t.mappings {
+		used = append(used, m.Port)
+	}
+	sort.Ints(used)
+	port := 0
+	gap := 0
+	for i := 1; i < len(used); i++ {
+		if used[i]-used[i-1] > gap {
+			gap = used[i] - used[i-1]
+			port = used[i-1] + gap/2
+		}
+	}
+	return port
+}
+
+func (t *tcpTest) accepted() bool {
+	for _, m := range t.expected {
+		if t.mappings[m] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *tcpTest) receive(c *connection, p probe, now time.Time) {}
+
+func (t *tcpTest) connected(c *connection, m *MessageConnect, now time.Time) {
+	f, ok := t.pending[m.ID]
+	if !ok {
+		return
+	}
+	delete(t.pending, m.ID)
+	if f != nil {
+		f(m.Result)
+	}
+}
+
+func (t *tcpTest) accept(c *connection, p probe, now time.Time) {
+	if p.clientPort >= len(c.ports) {
+		return
+	}
+	t.mappings[tcpMapping{clientPort: p.clientPort, relay: p.relay, relayPort: p.relayPort}] = &net.TCPAddr{
+		IP:   p.ip,
+		Port: p.port,
+	}
+}
+
+func (t *tcpTest) finish(result *MessageResult) {
+	m := t.mappings[tcpMapping{clientPort: 0, relay: 0, relayPort: 0}]
+	if m == nil {
+		result.TCP = &TCP{
+			Blocked: true,
+		}
+		return
+	}
+	r := &TCP{
+		Unsolicited:  t.unsolicited,
+		HolePunching: t.openClient == ConnectConnected && t.openRelay == ConnectConnected,
+	}
+	if e := t.mappings[tcpMapping{clientPort: 0, relay: 1, relayPort: 0}]; e != nil && e.Port == m.Port && e.IP.Equal(m.IP) {
+		r.Mapping = EndpointIndependent
+	} else if p := t.mappings[tcpMapping{clientPort: 0, relay: 0, relayPort: 1}]; p != nil && p.Port == m.Port && p.IP.Equal(m.IP) {
+		r.Mapping = AddressDependent
+	} else {
+		r.Mapping = AddressAndPortDependent
+	}
+	if t.filteringEndpoint == ConnectConnected {
+		r.Filtering = EndpointIndependent
+	} else if t.filteringPort == ConnectConnected {
+		r.Filtering = AddressDependent
+	} else {
+		r.Filtering = AddressAndPortDependent
+	}
+	result.TCP = r
+}
@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/client"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+)
+
+// TestTCPBehavior checks the TCP behaviors reported for NATs with TCP mappings.
+func TestTCPBehavior(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	tests := []struct {
+		name         string
+		config       netsim.NATConfig
+		mapping      Behavior
+		filtering    Behavior
+		holePunching bool
+	}{{
+		name:         "full cone",
+		config:       netsim.NATConfig{},
+		mapping:      EndpointIndependent,
+		filtering:    EndpointIndependent,
+		holePunching: true,
+	}, {
+		name: "port restricted cone",
+		config: netsim.NATConfig{
+			Filtering: AddressAndPortDependent,
+		},
+		mapping:      EndpointIndependent,
+		filtering:    AddressAndPortDependent,
+		holePunching: true,
+	}, {
+		name: "symmetric",
+		config: netsim.NATConfig{
+			Mapping:   AddressAndPortDependent,
+			Filtering: AddressAndPortDependent,
+		},
+		mapping:   AddressAndPortDependent,
+		filtering: AddressAndPortDependent,
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			n := netsim.New(1)
+			netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+			clientHost := n.AddHost("192.168.0.2", n.AddNAT(test.config, "5.0.0.1"))
+
+			result, err := netsimtest.Check(ctx, client.Options{
+				Transport: clientHost,
+				TCP:       true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := result.TCP
+			if r == nil || r.Blocked {
+				t.Fatalf("expected TCP behaviors, got %s", result.String())
+			}
+			if r.Mapping != test.mapping {
+				t.Errorf("expected TCP mapping %q, got %q", test.mapping, r.Mapping)
+			}
+			if r.Filtering != test.filtering {
+				t.Errorf("expected TCP filtering %q, got %q", test.filtering, r.Filtering)
+			}
+			if r.Unsolicited != ConnectTimeout {
+				t.Errorf("expected unsolicited SYNs to time out, got %q", r.Unsolicited)
+			}
+			if r.HolePunching != test.holePunching {
+				t.Errorf("expected hole punching %t, got %t", test.holePunching, r.HolePunching)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/classify"
+)
+
+var DefaultPort = 3478
+var DefaultTimeout = 3 * time.Second
+
+// requestInterval is the delay between retransmissions of a request
+var requestInterval = 250 * time.Millisecond
+
+type Options struct {
+	// Server is the STUN server hostname[:port]. It must support RFC 5780,
+	// with an alternate IP and port. The port defaults to DefaultPort.
+	Server string
+	// IPv6 runs the test over IPv6 rather than IPv4.
+	IPv6 bool
+	// Timeout is the time to wait for each response, after which the
+	// response is considered lost. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Debug, if set, receives debug logs.
+	Debug *log.Logger
+	// Transport, if set, creates the network connections. Defaults to
+	// NetTransport.
+	Transport punch.Transport
+}
+
+// Check runs the mapping, filtering and hairpinning tests against a STUN
+// server, and returns the verdicts like a punch-check server would.
+//
+// The primary address of the server is used as relay port A0, its primary IP
+// with its alternate port as A1, and its alternate IP with its primary port as
+// B0. Filtering is tested with CHANGE-REQUEST, so that responses to C1 are
+// sent from A1, and from the alternate IP and port.
+func Check(ctx context.Context, options Options) (*punch.MessageResult, error) {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Debug == nil {
+		options.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	if options.Transport == nil {
+		options.Transport = punch.NetTransport
+	}
+	network := "udp4"
+	if options.IPv6 {
+		network = "udp6"
+	}
+
+	host := options.Server
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(DefaultPort))
+	}
+	a0, err := net.ResolveUDPAddr(network, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving STUN server host %q: %v", options.Server, err)
+	}
+
+	var cs [3]net.PacketConn
+	for i := range cs {
+		c, err := options.Transport.ListenPacket(network, ":0")
+		if err != nil {
+			return nil, fmt.Errorf("creating UDP socket: %v", err)
+		}
+		defer c.Close()
+		cs[i] = c
+	}
+	var o classify.Observations
+	o.NATPorts = make([]int, len(cs))
+	o.NATIPs = make([]net.IP, len(cs))
+	for _, c := range cs {
+		port := 0
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+			port = addr.Port
+		}
+		o.Ports = append(o.Ports, port)
+	}
+
+	res, err := request(ctx, cs[0], a0, 0, options) // C0 -> A0
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return classify.Classify(&o), nil
+	}
+	mapped, err := res.MappedAddress()
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN response: %v", err)
+	}
+	o.IP = mapped.IP
+	o.NATIPs[0] = mapped.IP
+	o.NATPorts[0] = mapped.Port
+	other, err := res.OtherAddress()
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN response: %v", err)
+	}
+	if other == nil {
+		return nil, fmt.Errorf("STUN server does not support RFC 5780: no alternate address")
+	}
+	a1 := &net.UDPAddr{IP: a0.IP, Port: other.Port}
+	b0 := &net.UDPAddr{IP: other.IP, Port: a0.Port}
+
+	// the tests of each socket run in sequence, sockets run in parallel
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(cs))
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	run(func() error { // mapping
+		mapped, err := mappedAddress(ctx, cs[0], a1, options) // C0 -> A1
+		if err != nil || mapped == nil {
+			return err
+		}
+		o.PortDependentNATIP = mapped.IP
+		o.PortDependentNATPort = mapped.Port
+		mapped, err = mappedAddress(ctx, cs[0], b0, options) // C0 -> B0
+		if err != nil || mapped == nil {
+			return err
+		}
+		o.EndpointDependentNATIP = mapped.IP
+		o.EndpointDependentNATPort = mapped.Port
+		return nil
+	})
+	run(func() error { // filtering
+		mapped, err := mappedAddress(ctx, cs[1], a0, options) // C1 -> A0, A0 -> C1
+		if err != nil || mapped == nil {
+			return err
+		}
+		o.Received = true
+		o.NATIPs[1] = mapped.IP
+		o.NATPorts[1] = mapped.Port
+		res, err := request(ctx, cs[1], a0, ChangePort, options) // A1 -> C1
+		if err != nil {
+			return err
+		}
+		o.ReceivedPortDependent = res != nil
+		res, err = request(ctx, cs[1], a0, ChangeIP|ChangePort, options) // B1 -> C1
+		if err != nil {
+			return err
+		}
+		o.ReceivedEndpointDependent = res != nil
+		return nil
+	})
+	run(func() error {
+		mapped, err := mappedAddress(ctx, cs[2], a0, options) // C2 -> A0
+		if err != nil || mapped == nil {
+			return err
+		}
+		o.NATIPs[2] = mapped.IP
+		o.NATPorts[2] = mapped.Port
+		return nil
+	})
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+
+	if o.NATPorts[1] != 0 { // C2 -> C1
+		o.ReceivedHairpinning, err = hairpinning(ctx, cs[2], cs[1], &net.UDPAddr{IP: o.NATIPs[1], Port: o.NATPorts[1]}, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := classify.Classify(&o)
+	result.Untested = []string{punch.TestBurst}
+	return result, nil
+}
+
+// Bind sends a binding request from c to a STUN server, and returns the
+// mapped address of c, as seen by the server.
+func Bind(ctx context.Context, c net.PacketConn, server *net.UDPAddr, options Options) (*net.UDPAddr, error) {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Debug == nil {
+		options.Debug = log.New(ioutil.Discard, "", 0)
+	}
+	mapped, err := mappedAddress(ctx, c, server, options)
+	if err != nil {
+		return nil, err
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("no STUN response from %v", server)
+	}
+	return mapped, nil
+}
+
+func mappedAddress(ctx context.Context, c net.PacketConn, addr *net.UDPAddr, options Options) (*net.UDPAddr, error) {
+	res, err := request(ctx, c, addr, 0, options)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	mapped, err := res.MappedAddress()
+	if err != nil {
+		return nil, fmt.Errorf("invalid STUN response: %v", err)
+	}
+	return mapped, nil
+}
+
+func newRequest() *Message {
+	m := &Message{
+		Type: TypeBindingRequest,
+	}
+	rand.Read(m.TransactionID[:])
+	return m
+}
+
+// request sends a binding request from c until a response is received, and
+// returns nil if no response is received before the timeout.
+func request(ctx context.Context, c net.PacketConn, addr *net.UDPAddr, change byte, options Options) (*Message, error) {
+	req := newRequest()
+	if change != 0 {
+		req.Add(AttrChangeRequest, []byte{0, 0, 0, change})
+	}
+	data := req.Marshal()
+	res, err := await(ctx, c, options.Timeout, func() {
+		options.Debug.Printf("sending binding request to %v with change flags %#x", addr, change)
+		c.WriteTo(data, addr)
+	}, func(m *Message) bool {
+		return m.TransactionID == req.TransactionID && (m.Type == TypeBindingResponse || m.Type == TypeBindingError)
+	})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	if res.Type == TypeBindingError {
+		code, reason := res.ErrorCode()
+		return nil, fmt.Errorf("STUN server error %d: %s", code, reason)
+	}
+	return res, nil
+}
+
+// hairpinning sends binding requests from src to the mapped address of dst,
+// and returns whether dst received one.
+func hairpinning(ctx context.Context, src net.PacketConn, dst net.PacketConn, mapped *net.UDPAddr, options Options) (bool, error) {
+	req := newRequest()
+	data := req.Marshal()
+	res, err := await(ctx, dst, options.Timeout, func() {
+		options.Debug.Printf("sending binding request to %v", mapped)
+		src.WriteTo(data, mapped)
+	}, func(m *Message) bool {
+		return m.TransactionID == req.TransactionID && m.Type == TypeBindingRequest
+	})
+	return res != nil, err
+}
+
+// await calls send every requestInterval, and reads from c until a message
+// matches or the timeout passes, in which case it returns nil.
+func await(ctx context.Context, c net.PacketConn, timeout time.Duration, send func(), match func(m *Message) bool) (*Message, error) {
+	defer c.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1536)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, nil
+		}
+		send()
+		next := now.Add(requestInterval)
+		if deadline.Before(next) {
+			next = deadline
+		}
+		c.SetReadDeadline(next)
+		for {
+			n, _, err := c.ReadFrom(buf)
+			if err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("reading from UDP socket: %v", err)
+			}
+			m, err := Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			if match(m) {
+				return m, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package stun_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/delthas/punch-check"
+	"github.com/delthas/punch-check/netsim"
+	"github.com/delthas/punch-check/netsim/netsimtest"
+	"github.com/delthas/punch-check/stun"
+)
+
+func TestSTUN(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	tests := []struct {
+		name      string
+		config    netsim.NATConfig
+		mapping   Behavior
+		filtering Behavior
+	}{
+		{"full cone", netsim.NATConfig{Hairpinning: true}, EndpointIndependent, EndpointIndependent},
+		{"restricted cone", netsim.NATConfig{Filtering: AddressDependent}, EndpointIndependent, AddressDependent},
+		{"port restricted cone", netsim.NATConfig{Filtering: AddressAndPortDependent}, EndpointIndependent, AddressAndPortDependent},
+		{"address dependent mapping", netsim.NATConfig{Mapping: AddressDependent, Filtering: AddressAndPortDependent}, AddressDependent, AddressAndPortDependent},
+		{"symmetric", netsim.NATConfig{Mapping: AddressAndPortDependent, Filtering: AddressAndPortDependent}, AddressAndPortDependent, AddressAndPortDependent},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			n := netsim.New(1)
+			var s stun.Server
+			for i, ip := range []string{"4.0.0.1", "4.0.0.2"} {
+				h := n.AddHost(ip, nil)
+				for j, port := range []string{":3478", ":3479"} {
+					c, err := h.ListenPacket("udp4", port)
+					if err != nil {
+						t.Fatal(err)
+					}
+					s.Conns[i][j] = c
+				}
+			}
+			go s.Serve()
+			defer s.Conns[0][0].Close()
+			clientHost := n.AddHost("192.168.0.2", n.AddNAT(test.config, "5.0.0.1"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			r, err := stun.Check(ctx, stun.Options{
+				Server:    "4.0.0.1",
+				Timeout:   500 * time.Millisecond,
+				Transport: clientHost,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			netsimtest.ExpectBehaviors(t, r, test.mapping, test.filtering)
+			if r.Hairpinning != test.config.Hairpinning {
+				t.Errorf("expected hairpinning %v, got %v", test.config.Hairpinning, r.Hairpinning)
+			}
+			if t.Failed() {
+				t.Logf("result: %s", r.String())
+			}
+		})
+	}
+}
+
+func TestSTUNRelay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulated NAT tests in short mode")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	n := netsim.New(1)
+	netsimtest.Serve(t, ctx, n, netsimtest.Config{})
+	clientHost := n.AddHost("192.168.0.2", n.AddNAT(netsim.NATConfig{}, "5.0.0.1"))
+	c, err := clientHost.ListenPacket("udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mapped, err := stun.Bind(ctx, c, &net.UDPAddr{IP: net.IPv4(2, 0, 0, 1), Port: 1000}, stun.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mapped.IP.Equal(net.IPv4(5, 0, 0, 1)) {
+		t.Errorf("expected mapped IP 5.0.0.1, got %v", mapped.IP)
+	}
+}
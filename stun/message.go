@@ -0,0 +1,238 @@
+// Package stun runs the punch-check NAT tests against RFC 5780 STUN servers,
+// and answers STUN binding requests.
+//
+// Only the parts of RFC 5389 and RFC 5780 needed for NAT behavior discovery
+// are supported: binding requests and responses over UDP, without
+// authentication.
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const magicCookie = 0x2112A442
+
+const headerLength = 20
+
+const (
+	TypeBindingRequest  uint16 = 0x0001
+	TypeBindingResponse uint16 = 0x0101
+	TypeBindingError    uint16 = 0x0111
+)
+
+const (
+	AttrMappedAddress     uint16 = 0x0001
+	AttrChangeRequest     uint16 = 0x0003
+	AttrChangedAddress    uint16 = 0x0005 // RFC 3489 name of OTHER-ADDRESS
+	AttrErrorCode         uint16 = 0x0009
+	AttrUnknownAttributes uint16 = 0x000A
+	AttrXORMappedAddress  uint16 = 0x0020
+	AttrSoftware          uint16 = 0x8022
+	AttrResponseOrigin    uint16 = 0x802B
+	AttrOtherAddress      uint16 = 0x802C
+)
+
+// CHANGE-REQUEST flags
+const (
+	ChangePort byte = 0x02
+	ChangeIP   byte = 0x04
+)
+
+const (
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a STUN message.
+type Message struct {
+	Type          uint16
+	TransactionID [12]byte
+	Attributes    []Attribute
+}
+
+var errNotSTUN = errors.New("not a STUN message")
+
+// Parse parses a STUN message. It returns an error if data is not a STUN
+// message, such as a punch-check probe.
+func Parse(data []byte) (*Message, error) {
+	if len(data) < headerLength || data[0]&0xC0 != 0 || binary.BigEndian.Uint32(data[4:8]) != magicCookie {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || headerLength+length != len(data) {
+		return nil, errNotSTUN
+	}
+	m := &Message{
+		Type: binary.BigEndian.Uint16(data[0:2]),
+	}
+	copy(m.TransactionID[:], data[8:20])
+	data = data[headerLength:]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("invalid STUN attribute header")
+		}
+		t := binary.BigEndian.Uint16(data[0:2])
+		n := int(binary.BigEndian.Uint16(data[2:4]))
+		padded := (n + 3) &^ 3
+		if len(data) < 4+padded {
+			return nil, fmt.Errorf("invalid STUN attribute length: %d", n)
+		}
+		m.Attributes = append(m.Attributes, Attribute{
+			Type:  t,
+			Value: data[4 : 4+n],
+		})
+		data = data[4+padded:]
+	}
+	return m, nil
+}
+
+// Marshal returns the wire encoding of m.
+func (m *Message) Marshal() []byte {
+	length := 0
+	for _, a := range m.Attributes {
+		length += 4 + (len(a.Value)+3)&^3
+	}
+	data := make([]byte, headerLength+length)
+	binary.BigEndian.PutUint16(data[0:2], m.Type)
+	binary.BigEndian.PutUint16(data[2:4], uint16(length))
+	binary.BigEndian.PutUint32(data[4:8], magicCookie)
+	copy(data[8:20], m.TransactionID[:])
+	b := data[headerLength:]
+	for _, a := range m.Attributes {
+		binary.BigEndian.PutUint16(b[0:2], a.Type)
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(a.Value)))
+		copy(b[4:], a.Value)
+		b = b[4+(len(a.Value)+3)&^3:]
+	}
+	return data
+}
+
+// Get returns the value of the first attribute of type t, or nil.
+func (m *Message) Get(t uint16) []byte {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func (m *Message) Add(t uint16, value []byte) {
+	m.Attributes = append(m.Attributes, Attribute{
+		Type:  t,
+		Value: value,
+	})
+}
+
+// AddAddress adds an address attribute, XOR-encoded for
+// AttrXORMappedAddress.
+func (m *Message) AddAddress(t uint16, addr *net.UDPAddr) {
+	family := familyIPv4
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = familyIPv6
+		ip = addr.IP.To16()
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = byte(family)
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:], ip)
+	if t == AttrXORMappedAddress {
+		m.xor(value)
+	}
+	m.Add(t, value)
+}
+
+// Address returns the value of the first address attribute of type t, or nil.
+func (m *Message) Address(t uint16) (*net.UDPAddr, error) {
+	value := m.Get(t)
+	if value == nil {
+		return nil, nil
+	}
+	if len(value) < 4 {
+		return nil, fmt.Errorf("invalid STUN address length: %d", len(value))
+	}
+	switch value[1] {
+	case familyIPv4:
+		if len(value) != 4+net.IPv4len {
+			return nil, fmt.Errorf("invalid STUN IPv4 address length: %d", len(value))
+		}
+	case familyIPv6:
+		if len(value) != 4+net.IPv6len {
+			return nil, fmt.Errorf("invalid STUN IPv6 address length: %d", len(value))
+		}
+	default:
+		return nil, fmt.Errorf("invalid STUN address family: %d", value[1])
+	}
+	value = append([]byte(nil), value...)
+	if t == AttrXORMappedAddress {
+		m.xor(value)
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(value[4:]),
+		Port: int(binary.BigEndian.Uint16(value[2:4])),
+	}, nil
+}
+
+// xor applies the XOR-MAPPED-ADDRESS obfuscation to an address value.
+func (m *Message) xor(value []byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], m.TransactionID[:])
+	value[2] ^= key[0]
+	value[3] ^= key[1]
+	for i := range value[4:] {
+		value[4+i] ^= key[i]
+	}
+}
+
+// MappedAddress returns the mapped address of a binding response.
+func (m *Message) MappedAddress() (*net.UDPAddr, error) {
+	addr, err := m.Address(AttrXORMappedAddress)
+	if err != nil || addr != nil {
+		return addr, err
+	}
+	addr, err = m.Address(AttrMappedAddress)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("no mapped address in STUN response")
+	}
+	return addr, nil
+}
+
+// OtherAddress returns the alternate address of the server, or nil.
+func (m *Message) OtherAddress() (*net.UDPAddr, error) {
+	addr, err := m.Address(AttrOtherAddress)
+	if err != nil || addr != nil {
+		return addr, err
+	}
+	return m.Address(AttrChangedAddress)
+}
+
+// ErrorCode returns the error code and reason of an error response.
+func (m *Message) ErrorCode() (int, string) {
+	value := m.Get(AttrErrorCode)
+	if len(value) < 4 {
+		return 0, ""
+	}
+	return int(value[2]&0x07)*100 + int(value[3]), string(value[4:])
+}
+
+// AddError adds an ERROR-CODE attribute.
+func (m *Message) AddError(code int, reason string) {
+	value := make([]byte, 4+len(reason))
+	value[2] = byte(code / 100)
+	value[3] = byte(code % 100)
+	copy(value[4:], reason)
+	m.Add(AttrErrorCode, value)
+}
@@ -0,0 +1,160 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// transactionID is the transaction ID of the sample responses of RFC 5769
+var transactionID = [12]byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+
+func TestMessage(t *testing.T) {
+	m := &Message{
+		Type:          TypeBindingError,
+		TransactionID: transactionID,
+	}
+	m.Add(AttrSoftware, []byte("punch")) // padded to 8 bytes
+	m.Add(AttrChangeRequest, []byte{0, 0, 0, ChangeIP | ChangePort})
+	m.Add(AttrUnknownAttributes, nil)
+	m.AddError(420, "Unknown Attribute")
+	data := m.Marshal()
+	if len(data)%4 != 0 || int(binary.BigEndian.Uint16(data[2:4])) != len(data)-headerLength {
+		t.Fatalf("invalid message length: %d", len(data))
+	}
+
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Type != m.Type || parsed.TransactionID != m.TransactionID {
+		t.Errorf("expected header %#04x %x, got %#04x %x", m.Type, m.TransactionID, parsed.Type, parsed.TransactionID)
+	}
+	if len(parsed.Attributes) != len(m.Attributes) {
+		t.Fatalf("expected %d attributes, got %d", len(m.Attributes), len(parsed.Attributes))
+	}
+	for i, a := range m.Attributes {
+		if parsed.Attributes[i].Type != a.Type || !bytes.Equal(parsed.Attributes[i].Value, a.Value) {
+			t.Errorf("attribute %d: expected %#04x %x, got %#04x %x", i, a.Type, a.Value, parsed.Attributes[i].Type, parsed.Attributes[i].Value)
+		}
+	}
+	if v := parsed.Get(AttrSoftware); string(v) != "punch" {
+		t.Errorf("expected software %q, got %q", "punch", v)
+	}
+	if v := parsed.Get(AttrOtherAddress); v != nil {
+		t.Errorf("expected no other address, got %x", v)
+	}
+	if code, reason := parsed.ErrorCode(); code != 420 || reason != "Unknown Attribute" {
+		t.Errorf("expected error 420 Unknown Attribute, got %d %s", code, reason)
+	}
+}
+
+func TestXORMappedAddress(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  *net.UDPAddr
+		value []byte
+	}{{
+		name:  "IPv4",
+		addr:  &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 32853},
+		value: []byte{0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43},
+	}, {
+		name: "IPv6",
+		addr: &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853},
+		value: []byte{0x00, 0x02, 0xa1, 0x47, 0x01, 0x13, 0xa9, 0xfa, 0xa5, 0xd3, 0xf1, 0x79,
+			0xbc, 0x25, 0xf4, 0xb5, 0xbe, 0xd2, 0xb9, 0xd9},
+	}}
+	for _, test := range tests {
+		m := &Message{
+			Type:          TypeBindingResponse,
+			TransactionID: transactionID,
+		}
+		m.AddAddress(AttrXORMappedAddress, test.addr)
+		if v := m.Get(AttrXORMappedAddress); !bytes.Equal(v, test.value) {
+			t.Errorf("%s: expected encoding %x, got %x", test.name, test.value, v)
+		}
+
+		parsed, err := Parse(m.Marshal())
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		addr, err := parsed.MappedAddress()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !addr.IP.Equal(test.addr.IP) || addr.Port != test.addr.Port {
+			t.Errorf("%s: expected %v, got %v", test.name, test.addr, addr)
+		}
+	}
+
+	// MAPPED-ADDRESS is not XOR-encoded, and used without XOR-MAPPED-ADDRESS
+	m := &Message{
+		Type:          TypeBindingResponse,
+		TransactionID: transactionID,
+	}
+	m.AddAddress(AttrMappedAddress, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853})
+	if v := m.Get(AttrMappedAddress); !bytes.Equal(v, []byte{0x00, 0x01, 0x80, 0x55, 192, 0, 2, 1}) {
+		t.Errorf("unexpected MAPPED-ADDRESS encoding: %x", v)
+	}
+	if addr, err := m.MappedAddress(); err != nil || addr.String() != "192.0.2.1:32853" {
+		t.Errorf("expected 192.0.2.1:32853, got %v, %v", addr, err)
+	}
+	m.Attributes = nil
+	if _, err := m.MappedAddress(); err == nil {
+		t.Errorf("expected an error without mapped address")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := (&Message{
+		Type:          TypeBindingRequest,
+		TransactionID: transactionID,
+	}).Marshal()
+	withAttribute := func(header []byte, value []byte) []byte {
+		data := append(append(append([]byte(nil), valid...), header...), value...)
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-headerLength))
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", valid[:headerLength-1]},
+		{"probe", []byte{0x80, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"invalid magic cookie", append([]byte{0, 1, 0, 0, 0x21, 0x12, 0xa4, 0x43}, transactionID[:]...)},
+		{"truncated body", withAttribute([]byte{0x80, 0x22, 0, 4}, []byte{1, 2, 3, 4})[:headerLength+4]},
+		{"unaligned length", withAttribute([]byte{0x80, 0x22, 0, 1}, []byte{1})},
+		{"attribute past the end", withAttribute([]byte{0x80, 0x22, 0, 8}, []byte{1, 2, 3, 4})},
+		{"unpadded attribute", withAttribute([]byte{0x80, 0x22, 0, 5}, []byte{1, 2, 3, 4})},
+	}
+	if _, err := Parse(valid); err != nil {
+		t.Fatalf("valid message: %v", err)
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.data); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	addresses := []struct {
+		name  string
+		value []byte
+	}{
+		{"truncated", []byte{0, 1, 0}},
+		{"invalid family", []byte{0, 3, 0, 1, 1, 2, 3, 4}},
+		{"invalid IPv4 length", []byte{0, 1, 0, 1, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"invalid IPv6 length", []byte{0, 2, 0, 1, 1, 2, 3, 4}},
+	}
+	for _, test := range addresses {
+		m := &Message{
+			Type:          TypeBindingResponse,
+			TransactionID: transactionID,
+		}
+		m.Add(AttrXORMappedAddress, test.value)
+		if _, err := m.MappedAddress(); err == nil {
+			t.Errorf("address %s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package stun
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+var Software = "punch-check"
+
+// Server answers STUN binding requests, including the RFC 5780
+// CHANGE-REQUEST attribute.
+type Server struct {
+	// Conns are the sockets of the server: Conns[i][j] is bound to its primary
+	// (i = 0) or alternate (i = 1) IP, and its primary (j = 0) or alternate
+	// (j = 1) port. Missing sockets are nil, in which case requests to respond
+	// from them are rejected.
+	Conns [2][2]net.PacketConn
+	// Allow, if set, is called before answering a binding request from addr,
+	// and the request is dropped if it returns false.
+	Allow func(addr *net.UDPAddr) bool
+}
+
+// Serve answers the requests received on all the sockets of s, until reading
+// from one of them fails. It then closes all the sockets and returns the
+// error.
+func (s *Server) Serve() error {
+	var once sync.Once
+	var err error
+	var wg sync.WaitGroup
+	for i := range s.Conns {
+		for j, c := range s.Conns[i] {
+			if c == nil {
+				continue
+			}
+			i, j, c := i, j, c
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 1536)
+				for {
+					n, a, e := c.ReadFrom(buf)
+					if e != nil {
+						once.Do(func() {
+							err = e
+							s.close()
+						})
+						return
+					}
+					if addr, ok := a.(*net.UDPAddr); ok {
+						s.Handle(i, j, buf[:n], addr)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return err
+}
+
+func (s *Server) close() {
+	for i := range s.Conns {
+		for _, c := range s.Conns[i] {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+}
+
+// Handle answers a packet received from addr on s.Conns[ip][port], and
+// returns whether it was a STUN binding request.
+func (s *Server) Handle(ip int, port int, data []byte, addr *net.UDPAddr) bool {
+	req, err := Parse(data)
+	if err != nil || req.Type != TypeBindingRequest {
+		return false
+	}
+	if s.Allow != nil && !s.Allow(addr) {
+		return true
+	}
+
+	var unknown []uint16
+	var change byte
+	for _, a := range req.Attributes {
+		switch {
+		case a.Type == AttrChangeRequest && len(a.Value) == 4:
+			change = a.Value[3]
+		case a.Type < 0x8000: // comprehension-required
+			unknown = append(unknown, a.Type)
+		}
+	}
+	other := s.Conns[1-ip][1-port]
+	if change&ChangeIP != 0 {
+		ip = 1 - ip
+	}
+	if change&ChangePort != 0 {
+		port = 1 - port
+	}
+	c := s.Conns[ip][port]
+	if c == nil { // the server cannot respond from the requested address
+		c = s.Conns[0][0]
+		unknown = append(unknown, AttrChangeRequest)
+	}
+
+	res := &Message{
+		TransactionID: req.TransactionID,
+	}
+	if len(unknown) > 0 {
+		res.Type = TypeBindingError
+		res.AddError(420, "Unknown Attribute")
+		value := make([]byte, 2*len(unknown))
+		for i, t := range unknown {
+			binary.BigEndian.PutUint16(value[2*i:], t)
+		}
+		res.Add(AttrUnknownAttributes, value)
+		res.Add(AttrSoftware, []byte(Software))
+		c.WriteTo(res.Marshal(), addr)
+		return true
+	}
+	res.Type = TypeBindingResponse
+	res.AddAddress(AttrXORMappedAddress, addr)
+	res.AddAddress(AttrMappedAddress, addr)
+	if origin := localAddr(c); origin != nil {
+		res.AddAddress(AttrResponseOrigin, origin)
+	}
+	if other != nil {
+		if other := localAddr(other); other != nil {
+			res.AddAddress(AttrOtherAddress, other)
+		}
+	}
+	res.Add(AttrSoftware, []byte(Software))
+	c.WriteTo(res.Marshal(), addr)
+	return true
+}
+
+// localAddr returns the local address of c, if it is bound to a specific IP.
+func localAddr(c net.PacketConn) *net.UDPAddr {
+	addr, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP == nil || addr.IP.IsUnspecified() {
+		return nil
+	}
+	return addr
+}
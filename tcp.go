@@ -0,0 +1,51 @@
+package punch
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// TCPTransport is a Transport that can open TCP connections from a local port
+// it also listens on, for the TCP behavior test.
+type TCPTransport interface {
+	Transport
+	// Listen listens on a TCP port, which can also be used by DialFrom.
+	Listen(network string, address string) (net.Listener, error)
+	// DialFrom opens a TCP connection from localPort.
+	DialFrom(ctx context.Context, network string, localPort int, address string) (net.Conn, error)
+}
+
+func (netTransport) Listen(network string, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: reusePort,
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+func (netTransport) DialFrom(ctx context.Context, network string, localPort int, address string) (net.Conn, error) {
+	localAddr, err := net.ResolveTCPAddr(network, net.JoinHostPort("", strconv.Itoa(localPort)))
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		LocalAddr: localAddr,
+		Control:   reusePort,
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// DialResult returns the ConnectResult of a TCP connection attempt that
+// returned err.
+func DialResult(err error) ConnectResult {
+	if err == nil {
+		return ConnectConnected
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return ConnectTimeout
+	}
+	if isRefused(err) {
+		return ConnectReset
+	}
+	return ConnectFailed
+}
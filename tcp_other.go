@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package punch
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return errors.New("reusing TCP ports is not supported on this platform")
+}
+
+func isRefused(err error) bool {
+	return false
+}
@@ -0,0 +1,24 @@
+package punch
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// reusePort lets TCP sockets bind to a port with a listener and other
+// connections.
+func reusePort(network string, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
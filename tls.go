@@ -0,0 +1,51 @@
+package punch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// TLSClient returns a TLS client connection over the control connection c to
+// the server hostname[:port]. The server name of config defaults to the server
+// hostname, even if the server address was resolved with an SRV lookup.
+func TLSClient(c net.Conn, config *tls.Config, server string) net.Conn {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return tls.Client(c, config)
+}
+
+// LoadTLSConfig returns a TLS configuration presenting the certificate of the
+// PEM files certFile and keyFile, if set, and verifying peers with the CA
+// certificates of the PEM file caFile rather than the system CAs, if set.
+func LoadTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("reading TLS CA file %q: no certificates found", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	return config, nil
+}